@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sync"
+)
+
+//the outcome of one item in a batch
+const (
+	batchRegistered = "registered"
+	batchDuplicate  = "duplicate"
+	batchFailed     = "failed"
+)
+
+//BatchPost holds the urls in a json batch request
+type BatchPost struct {
+	URLs []string `json:"urls"`
+}
+
+//BatchResult is what happened to one url or file in a batch
+type BatchResult struct {
+	URL    string `json:"url,omitempty"`
+	File   string `json:"file,omitempty"`
+	Status string `json:"status"`          //registered, duplicate or failed
+	ID     string `json:"id,omitempty"`    //the track, also set for duplicates
+	Error  string `json:"error,omitempty"` //set when failed, or duplicate of a deleted track
+}
+
+//batchItem is one thing to register. Either url or raw is set.
+type batchItem struct {
+	url  string
+	file string
+	raw  []byte
+}
+
+//registers many tracks at once. Takes a json with urls, or a multipart form
+//with any number of "url" fields and "file" uploads.
+func (s *server) handlAPIbatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		str := fmt.Sprintf("Sorry, only POST method is supported.")
+		errorHandler(w, http.StatusBadRequest, str)
+		return
+	}
+
+	//refuse bodies that are too big before reading anything
+	if !limitBody(w, r, s.maxUpload) {
+		return
+	}
+
+	items, err := readBatch(r)
+	if err != nil {
+		bodyError(w, "Batch error", err)
+		return
+	}
+	if len(items) == 0 {
+		errorHandler(w, http.StatusBadRequest, "Error: Nothing to register")
+		return
+	}
+	if len(items) > s.batchMax {
+		str := fmt.Sprintf("Error: at most %d tracks in one batch", s.batchMax)
+		errorHandler(w, http.StatusRequestEntityTooLarge, str)
+		return
+	}
+
+	writeJSON(w, s.registerBatch(items))
+}
+
+//readBatch gets the urls and files posted in r
+func readBatch(r *http.Request) ([]batchItem, error) {
+	var items []batchItem
+
+	mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediatype != "multipart/form-data" {
+		var post BatchPost
+		err := json.NewDecoder(r.Body).Decode(&post)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range post.URLs {
+			items = append(items, batchItem{url: u})
+		}
+		return items, nil
+	}
+
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range r.MultipartForm.Value["url"] {
+		items = append(items, batchItem{url: u})
+	}
+	for _, fh := range r.MultipartForm.File["file"] {
+		f, err := fh.Open()
+		if err != nil {
+			return nil, err
+		}
+		raw, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, batchItem{file: fh.Filename, raw: raw})
+	}
+	return items, nil
+}
+
+//registerBatch registers every item, at most s.batchWorkers at a time.
+//Results are in the same order as items.
+func (s *server) registerBatch(items []batchItem) []BatchResult {
+	results := make([]BatchResult, len(items))
+	sem := make(chan struct{}, s.batchWorkers)
+	var wg sync.WaitGroup
+
+	for i := range items {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			item := items[i]
+			var id string
+			var err error
+			if item.raw != nil {
+				id, err = s.register(item.raw)
+			} else {
+				id, err = s.registerURL(item.url)
+			}
+			results[i] = batchResult(item, id, err)
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+//batchResult tells what registering item gave
+func batchResult(item batchItem, id string, err error) BatchResult {
+	res := BatchResult{URL: item.url, File: item.file, ID: id}
+	switch {
+	case err == nil:
+		res.Status = batchRegistered
+	case err == errAlreadyRegistered:
+		res.Status = batchDuplicate
+	case err == errTrackDeleted:
+		res.Status = batchDuplicate
+		res.Error = err.Error()
+	default:
+		res.Status = batchFailed
+		res.Error = err.Error()
+	}
+	return res
+}
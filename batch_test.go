@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+//testIGC makes a small valid IGC file, fixes one second apart going north.
+//Different starts give different files.
+func testIGC(start, fixes int) string {
+	igc := "AXXX001\nHFDTE020718\nHFPLTPILOTINCHARGE: Test Pilot\n"
+	for i := 0; i < fixes; i++ {
+		s := start + i
+		igc += fmt.Sprintf("B%02d%02d%02d46%05dN00800000EA0050000500\n", 10+s/3600, s/60%60, s%60, i*10)
+	}
+	return igc
+}
+
+func TestBatchPanickingFile(t *testing.T) {
+	s := newTestServer()
+	ts := httptest.NewServer(newRouter(s))
+	defer ts.Close()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	files := []struct{ name, content string }{
+		{"first.igc", testIGC(0, 20)},
+		{"panic.igc", panicIGC},
+		{"last.igc", testIGC(100, 20)},
+	}
+	for _, f := range files {
+		fw, err := mw.CreateFormFile("file", f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(f.content))
+	}
+	mw.Close()
+
+	resp, err := http.Post(ts.URL+"/igcinfo/api/batch", mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var results []BatchResult
+	err = json.NewDecoder(resp.Body).Decode(&results)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("batch gave %d, %v, want 200 and results", resp.StatusCode, err)
+	}
+	if len(results) != len(files) {
+		t.Fatalf("got %d results, want %d", len(results), len(files))
+	}
+
+	want := []string{batchRegistered, batchFailed, batchRegistered}
+	for i, res := range results {
+		if res.File != files[i].name || res.Status != want[i] {
+			t.Errorf("result %d is %s %s (%s), want %s %s", i, res.File, res.Status, res.Error, files[i].name, want[i])
+		}
+	}
+	if n := len(s.store.List()); n != 2 {
+		t.Errorf("stored %d tracks, want 2", n)
+	}
+}
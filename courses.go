@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	igc "github.com/marni/goigc"
+)
+
+//the track is thinned to this many points before looking for courses.
+//Triangles are found in O(n³), so this is less than for free distance.
+const courseMaxPoints = 300
+
+//course shapes
+const (
+	shapeFAITriangle  = "fai_triangle"
+	shapeFlatTriangle = "flat_triangle"
+	shapeOutAndReturn = "out_and_return"
+)
+
+//ScoringRules say what closed courses are worth. Set them with SCORING_RULES,
+//as json with the fields to change, like {"fai_triangle": 1.5}.
+type ScoringRules struct {
+	FAITriangle  float64 `json:"fai_triangle"`   //points per km of FAI triangle
+	FlatTriangle float64 `json:"flat_triangle"`  //points per km of other triangles
+	OutAndReturn float64 `json:"out_and_return"` //points per km of out-and-return
+	FAIMinLeg    float64 `json:"fai_min_leg"`    //shortest leg of an FAI triangle, as a share of its distance
+	MaxClosing   float64 `json:"max_closing"`    //largest closing distance, as a share of the course distance
+}
+
+//defaultScoringRules are close to what most online leagues use
+var defaultScoringRules = ScoringRules{
+	FAITriangle:  1.4,
+	FlatTriangle: 1.2,
+	OutAndReturn: 1.2,
+	FAIMinLeg:    0.28,
+	MaxClosing:   0.2,
+}
+
+//parseScoringRules reads rules in json, starting from the defaults
+func parseScoringRules(s string) (ScoringRules, error) {
+	rules := defaultScoringRules
+	if s == "" {
+		return rules, nil
+	}
+	err := json.Unmarshal([]byte(s), &rules)
+	if err != nil {
+		return rules, err
+	}
+	if rules.FAIMinLeg < 0 || rules.FAIMinLeg > 1.0/3 {
+		return rules, fmt.Errorf("fai_min_leg must be from 0 to 1/3")
+	}
+	if rules.MaxClosing < 0 {
+		return rules, fmt.Errorf("max_closing can not be negative")
+	}
+	return rules, nil
+}
+
+//multiplier is what one km of shape is worth
+func (r ScoringRules) multiplier(shape string) float64 {
+	switch shape {
+	case shapeFAITriangle:
+		return r.FAITriangle
+	case shapeFlatTriangle:
+		return r.FlatTriangle
+	default:
+		return r.OutAndReturn
+	}
+}
+
+//Course is a closed course flown in a track
+type Course struct {
+	Shape           string      `json:"shape"`            //fai_triangle, flat_triangle or out_and_return
+	Vertices        []TaskPoint `json:"vertices"`         //the turnpoints, in the order flown
+	Distance        float64     `json:"distance"`         //km around the course
+	ClosingDistance float64     `json:"closing_distance"` //km between where the course was started and finished
+	Closing         []TaskPoint `json:"closing"`          //those two points
+	Score           float64     `json:"score"`            //(distance - closing_distance) * multiplier
+}
+
+//CourseResult is every kind of closed course found in a track
+type CourseResult struct {
+	Rules   ScoringRules `json:"rules"`
+	Best    *Course      `json:"best,omitempty"` //highest score. Missing if no course was closed.
+	Courses []Course     `json:"courses"`        //the best of each shape, highest score first
+}
+
+//closing is the nearest pair of points, one at or before a and one at or after b
+type closing struct {
+	dist     float64
+	from, to int
+}
+
+//findCourses looks for the best FAI triangle, flat triangle and out-and-return in pts
+func findCourses(pts []igc.Point, times []time.Time, rules ScoringRules) CourseResult {
+	res := CourseResult{Rules: rules, Courses: []Course{}}
+	if len(pts) < 3 {
+		return res
+	}
+
+	idx := thinIndexes(len(pts), courseMaxPoints)
+	n := len(idx)
+	dist := make([][]float64, n)
+	for i := range dist {
+		dist[i] = make([]float64, n)
+		for j := 0; j < i; j++ {
+			dist[i][j] = pts[idx[i]].Distance(pts[idx[j]])
+			dist[j][i] = dist[i][j]
+		}
+	}
+
+	//close[a][b] for a <= b, filled from the widest gap in
+	close := make([][]closing, n)
+	for a := range close {
+		close[a] = make([]closing, n)
+	}
+	for a := 0; a < n; a++ {
+		for b := n - 1; b >= a; b-- {
+			c := closing{dist[a][b], a, b}
+			if a > 0 && close[a-1][b].dist < c.dist {
+				c = close[a-1][b]
+			}
+			if b < n-1 && close[a][b+1].dist < c.dist {
+				c = close[a][b+1]
+			}
+			close[a][b] = c
+		}
+	}
+
+	best := make(map[string]*Course)
+	consider := func(shape string, distance float64, cl closing, vertices ...int) {
+		if cl.dist > rules.MaxClosing*distance {
+			return
+		}
+		score := (distance - cl.dist) * rules.multiplier(shape)
+		if old := best[shape]; old != nil && old.Score >= score {
+			return
+		}
+		c := &Course{
+			Shape:           shape,
+			Distance:        distance,
+			ClosingDistance: cl.dist,
+			Score:           score,
+		}
+		point := func(i int) TaskPoint {
+			p := pts[idx[i]]
+			return TaskPoint{p.Lat.Degrees(), p.Lng.Degrees(), times[idx[i]]}
+		}
+		for _, v := range vertices {
+			c.Vertices = append(c.Vertices, point(v))
+		}
+		c.Closing = []TaskPoint{point(cl.from), point(cl.to)}
+		best[shape] = c
+	}
+
+	for a := 0; a < n; a++ {
+		for b := a + 1; b < n; b++ {
+			consider(shapeOutAndReturn, 2*dist[a][b], close[a][b], a, b)
+			for c := b + 1; c < n; c++ {
+				legs := [3]float64{dist[a][b], dist[b][c], dist[c][a]}
+				d := legs[0] + legs[1] + legs[2]
+				if d == 0 {
+					continue
+				}
+				shape := shapeFAITriangle
+				for _, l := range legs {
+					if l < rules.FAIMinLeg*d {
+						shape = shapeFlatTriangle
+					}
+				}
+				consider(shape, d, close[a][c], a, b, c)
+			}
+		}
+	}
+
+	for _, c := range best {
+		res.Courses = append(res.Courses, *c)
+	}
+	sort.Slice(res.Courses, func(i, j int) bool {
+		return res.Courses[i].Score > res.Courses[j].Score
+	})
+	if len(res.Courses) > 0 {
+		res.Best = &res.Courses[0]
+	}
+	return res
+}
+
+//writes the best closed courses of a track and their scores
+func (s *server) handlAPIigcIDcourses(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	rec, err := s.store.Get(vars["ID"])
+	if err != nil {
+		errorHandler(w, http.StatusNotFound, fmt.Sprintf("Error: %s", err))
+		return
+	}
+	pts, times := rec.flightPoints(includeGround(r))
+	writeJSON(w, findCourses(pts, times, s.rules))
+}
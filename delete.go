@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//DeletedTrack tells about a soft deleted track and when it will be gone for good
+type DeletedTrack struct {
+	ID         string    `json:"id"`
+	Deleted    time.Time `json:"deleted"`
+	PurgeAfter time.Time `json:"purge_after"`
+}
+
+//soft deletes a track. It can be restored by an admin until the grace period is over.
+func (s *server) deleteTrack(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	now := time.Now()
+	err := s.store.SoftDelete(vars["ID"], now)
+	if err == errTrackNotFound {
+		errorHandler(w, http.StatusNotFound, fmt.Sprintf("Error: %s", err))
+		return
+	} else if err != nil {
+		str := fmt.Sprintf("Store error: %s", err)
+		errorHandler(w, http.StatusInternalServerError, str)
+		return
+	}
+	s.optimized.forget(vars["ID"])
+
+	writeJSON(w, DeletedTrack{vars["ID"], now, now.Add(s.deleteGrace)})
+}
+
+//lists soft deleted tracks that can still be restored
+func (s *server) handlAPIadminDeleted(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(w, r) {
+		return
+	}
+
+	//empty list rather than null in the json
+	list := []DeletedTrack{}
+	for _, rec := range s.store.ListDeleted() {
+		list = append(list, DeletedTrack{rec.ID, rec.Deleted, rec.Deleted.Add(s.deleteGrace)})
+	}
+	writeJSON(w, list)
+}
+
+//brings back a soft deleted track
+func (s *server) handlAPIadminRestore(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		str := fmt.Sprintf("Sorry, only POST method is supported.")
+		errorHandler(w, http.StatusBadRequest, str)
+		return
+	}
+	vars := mux.Vars(r)
+
+	err := s.store.Restore(vars["ID"])
+	if err == errTrackNotFound {
+		errorHandler(w, http.StatusNotFound, fmt.Sprintf("Error: %s", err))
+		return
+	} else if err != nil {
+		str := fmt.Sprintf("Store error: %s", err)
+		errorHandler(w, http.StatusInternalServerError, str)
+		return
+	}
+
+	writeJSON(w, POSTid{vars["ID"]})
+}
+
+//isAdmin checks that r has "Authorization: Bearer <ADMIN_TOKEN>". If not, it
+//answers the request and returns false. Without a token, admin is turned off.
+func (s *server) isAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if s.adminToken == "" {
+		errorHandler(w, http.StatusForbidden, "Error: Admin endpoints are turned off")
+		return false
+	}
+	given := []byte(r.Header.Get("Authorization"))
+	want := []byte("Bearer " + s.adminToken)
+	if subtle.ConstantTimeCompare(given, want) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		errorHandler(w, http.StatusUnauthorized, "Error: Wrong or missing admin token")
+		return false
+	}
+	return true
+}
+
+//purgeDeleted removes tracks that were soft deleted longer than the grace period ago
+func (s *server) purgeDeleted(now time.Time) {
+	for _, rec := range s.store.ListDeleted() {
+		if now.Sub(rec.Deleted) < s.deleteGrace {
+			continue
+		}
+		err := s.store.Delete(rec.ID)
+		if err != nil {
+			log.Printf("Could not purge %s: %s", rec.ID, err)
+		} else {
+			s.optimized.forget(rec.ID)
+			log.Printf("Purged %s, deleted %s", rec.ID, rec.Deleted.Format(time.RFC3339))
+		}
+	}
+}
+
+//purgeLoop runs purgeDeleted every interval until the program ends
+func (s *server) purgeLoop(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		s.purgeDeleted(now)
+	}
+}
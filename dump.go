@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	igc "github.com/marni/goigc"
+)
+
+//pointColumns are the columns every point dump has, before the IData extensions
+var pointColumns = []string{"time", "lat", "lng", "pressure_altitude", "gnss_altitude", "fix_validity", "satellites"}
+
+//iDataKeys gives the names of every IData extension used in pts, sorted
+func iDataKeys(pts []igc.Point) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, p := range pts {
+		for k := range p.IData {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//pointValues are the values of p, in the order of pointColumns
+func pointValues(p igc.Point, t time.Time) []interface{} {
+	validity := ""
+	if p.FixValidity != 0 {
+		validity = string(p.FixValidity)
+	}
+	return []interface{}{
+		t.Format(time.RFC3339),
+		p.Lat.Degrees(),
+		p.Lng.Degrees(),
+		p.PressureAltitude,
+		p.GNSSAltitude,
+		validity,
+		p.NumSatellites,
+	}
+}
+
+//writeCSV writes every fix of rec as a row, with a header row first.
+//Rows are written as they are made, so the whole file is never in memory.
+func writeCSV(w io.Writer, rec trackRecord, opts exportOptions) error {
+	pts, times := rec.Track.Points, pointTimes(rec.Track)
+	keys := iDataKeys(pts)
+
+	cw := csv.NewWriter(w)
+	err := cw.Write(append(append([]string{}, pointColumns...), keys...))
+	if err != nil {
+		return err
+	}
+	row := make([]string, len(pointColumns)+len(keys))
+	for i, p := range pts {
+		for c, v := range pointValues(p, times[i]) {
+			switch v := v.(type) {
+			case float64:
+				row[c] = strconv.FormatFloat(v, 'f', -1, 64)
+			default:
+				row[c] = fmt.Sprint(v)
+			}
+		}
+		for c, k := range keys {
+			row[len(pointColumns)+c] = p.IData[k]
+		}
+		err = cw.Write(row)
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+//writeNDJSON writes every fix of rec as a json object on its own line.
+//Keys are in the same order as the CSV columns, IData extensions last.
+func writeNDJSON(w io.Writer, rec trackRecord, opts exportOptions) error {
+	pts, times := rec.Track.Points, pointTimes(rec.Track)
+	keys := iDataKeys(pts)
+
+	bw := bufio.NewWriter(w)
+	var line bytes.Buffer
+	for i, p := range pts {
+		line.Reset()
+		line.WriteByte('{')
+		for c, v := range pointValues(p, times[i]) {
+			js, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			if c > 0 {
+				line.WriteByte(',')
+			}
+			fmt.Fprintf(&line, "%q:", pointColumns[c])
+			line.Write(js)
+		}
+		for _, k := range keys {
+			v, ok := p.IData[k]
+			if !ok {
+				continue
+			}
+			//keys come from the file, so they get json quoting like the values
+			key, err := json.Marshal(k)
+			if err != nil {
+				return err
+			}
+			js, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			line.WriteByte(',')
+			line.Write(key)
+			line.WriteByte(':')
+			line.Write(js)
+		}
+		line.WriteString("}\n")
+		_, err := bw.Write(line.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
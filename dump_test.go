@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	igc "github.com/marni/goigc"
+)
+
+func TestNDJSONOddIDataKeys(t *testing.T) {
+	var rec trackRecord
+	rec.Track.Points = []igc.Point{
+		igc.NewPoint(),
+		igc.NewPoint(),
+	}
+	//keys come straight from the I record, so they can be anything
+	rec.Track.Points[0].IData = map[string]string{"F\x01A": "035", "\xffSI": "09"}
+	rec.Track.Points[1].IData = map[string]string{"FXA": "\"quoted\""}
+
+	var out bytes.Buffer
+	err := writeNDJSON(&out, rec, exportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := 0
+	sc := bufio.NewScanner(&out)
+	for sc.Scan() {
+		lines++
+		var v map[string]interface{}
+		if err := json.Unmarshal(sc.Bytes(), &v); err != nil {
+			t.Errorf("line %d is not json: %s\n%s", lines, err, sc.Bytes())
+		}
+	}
+	if lines != 2 {
+		t.Errorf("got %d lines, want 2", lines)
+	}
+}
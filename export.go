@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	igc "github.com/marni/goigc"
+)
+
+//exportOptions are the query parameters every export format understands
+type exportOptions struct {
+	pressure bool   //use pressure altitude instead of GNSS altitude
+	color    string //climb or speed to color the track by, for formats that can. Empty for one color.
+}
+
+//parseExportOptions reads ?altitude= and ?color=
+func parseExportOptions(q url.Values) (exportOptions, error) {
+	var opts exportOptions
+	switch q.Get("altitude") {
+	case "", "gnss":
+	case "pressure":
+		opts.pressure = true
+	default:
+		return opts, fmt.Errorf("altitude must be gnss or pressure")
+	}
+	switch opts.color = q.Get("color"); opts.color {
+	case "", "climb", "speed":
+	default:
+		return opts, fmt.Errorf("color must be climb or speed")
+	}
+	return opts, nil
+}
+
+//altitude is the altitude of p the client asked for, in metres
+func (o exportOptions) altitude(p igc.Point) int64 {
+	if o.pressure {
+		return p.PressureAltitude
+	}
+	return p.GNSSAltitude
+}
+
+//exporter writes a track in some file format
+type exporter struct {
+	contentType string
+	extension   string
+	write       func(w io.Writer, rec trackRecord, opts exportOptions) error
+}
+
+//exporters are the formats tracks can be exported to, by the name used in ?format=
+var exporters = map[string]exporter{
+	"gpx":    {"application/gpx+xml", "gpx", writeGPX},
+	"kml":    {"application/vnd.google-earth.kml+xml", "kml", writeKML},
+	"kmz":    {"application/vnd.google-earth.kmz", "kmz", writeKMZ},
+	"csv":    {"text/csv; charset=utf-8", "csv", writeCSV},
+	"ndjson": {"application/x-ndjson", "ndjson", writeNDJSON},
+}
+
+//exportFormats lists the names of all formats, sorted
+func exportFormats() []string {
+	var names []string
+	for name := range exporters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//taskWaypoint is a point of a declared task, with what to call it
+type taskWaypoint struct {
+	igc.Point
+	name string //from the C record, or what kind of point it is
+	kind string //start, turnpoint or finish
+}
+
+//taskWaypoints gives the points of the declared task in t, or nothing if there's none
+func taskWaypoints(t igc.Task) []taskWaypoint {
+	if !hasTask(t) {
+		return nil
+	}
+	wps := []taskWaypoint{{t.Start, "Start", "start"}}
+	for i, p := range t.Turnpoints {
+		wps = append(wps, taskWaypoint{p, fmt.Sprintf("Turnpoint %d", i+1), "turnpoint"})
+	}
+	wps = append(wps, taskWaypoint{t.Finish, "Finish", "finish"})
+	for i := range wps {
+		if d := strings.TrimSpace(wps[i].Description); d != "" {
+			wps[i].name = d
+		}
+	}
+	return wps
+}
+
+//trackTitle is a short name for a track, like "John Doe 2018-07-02"
+func trackTitle(t igc.Track) string {
+	return strings.TrimSpace(t.Pilot + " " + t.Date.Format("2006-01-02"))
+}
+
+//trackDescription is the header of a track in a line of text
+func trackDescription(t igc.Track) string {
+	var parts []string
+	add := func(name, value string) {
+		if value = strings.TrimSpace(value); value != "" {
+			parts = append(parts, name+": "+value)
+		}
+	}
+	add("Pilot", t.Pilot)
+	add("Crew", t.Crew)
+	add("Glider", t.GliderType)
+	add("Glider ID", t.GliderID)
+	add("Competition ID", t.CompetitionID)
+	add("Class", t.CompetitionClass)
+	add("Flight recorder", t.FlightRecorder)
+	add("Logger", t.Manufacturer+" "+t.UniqueID)
+	return strings.Join(parts, ", ")
+}
+
+//writes a track as a file, in the format given with ?format=
+func (s *server) handlAPIigcIDexport(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	q := r.URL.Query()
+
+	format := q.Get("format")
+	exp, ok := exporters[format]
+	if !ok {
+		str := fmt.Sprintf("Error: format must be one of %s", strings.Join(exportFormats(), ", "))
+		errorHandler(w, http.StatusBadRequest, str)
+		return
+	}
+	opts, err := parseExportOptions(q)
+	if err != nil {
+		errorHandler(w, http.StatusBadRequest, fmt.Sprintf("Error: %s", err))
+		return
+	}
+
+	rec, err := s.store.Get(vars["ID"])
+	if err != nil {
+		errorHandler(w, http.StatusNotFound, fmt.Sprintf("Error: %s", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", exp.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", rec.ID+"."+exp.extension))
+	err = exp.write(w, rec, opts)
+	if err != nil {
+		//the header is sent already, so all we can do is stop
+		log.Printf("Export of %s failed: %s", rec.ID, err)
+	}
+}
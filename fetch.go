@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+//fetchError is what fetcher.fetch fails with. status is the http status
+//we should answer our own client with.
+type fetchError interface {
+	error
+	status() int
+}
+
+//badURLError means the url can't be parsed or has a scheme we don't fetch
+type badURLError struct {
+	url    string
+	reason string
+}
+
+func (e badURLError) Error() string {
+	return fmt.Sprintf("bad url %q: %s", e.url, e.reason)
+}
+
+func (e badURLError) status() int { return http.StatusBadRequest }
+
+//blockedAddressError means the host resolves to an address we won't connect to
+type blockedAddressError struct {
+	addr string
+}
+
+func (e blockedAddressError) Error() string {
+	return fmt.Sprintf("address %s is not allowed", e.addr)
+}
+
+func (e blockedAddressError) status() int { return http.StatusForbidden }
+
+//tooManyRedirectsError means we gave up following redirects
+type tooManyRedirectsError struct {
+	max int
+}
+
+func (e tooManyRedirectsError) Error() string {
+	return fmt.Sprintf("stopped after %d redirects", e.max)
+}
+
+func (e tooManyRedirectsError) status() int { return http.StatusBadRequest }
+
+//tooLargeError means the remote file is bigger than we accept
+type tooLargeError struct {
+	max int64
+}
+
+func (e tooLargeError) Error() string {
+	return fmt.Sprintf("file is larger than %d bytes", e.max)
+}
+
+func (e tooLargeError) status() int { return http.StatusRequestEntityTooLarge }
+
+//timeoutError means the remote host was too slow
+type timeoutError struct {
+	timeout time.Duration
+}
+
+func (e timeoutError) Error() string {
+	return fmt.Sprintf("no complete answer within %s", e.timeout)
+}
+
+func (e timeoutError) status() int { return http.StatusGatewayTimeout }
+
+//remoteStatusError means the remote host answered, but not with 200 OK
+type remoteStatusError struct {
+	code int
+}
+
+func (e remoteStatusError) Error() string {
+	return fmt.Sprintf("remote host answered %d %s", e.code, http.StatusText(e.code))
+}
+
+func (e remoteStatusError) status() int {
+	//a missing file is the fault of whoever gave us the url
+	if e.code >= 400 && e.code < 500 {
+		return http.StatusBadRequest
+	}
+	return http.StatusBadGateway
+}
+
+//connectError means we could not talk to the remote host at all
+type connectError struct {
+	err error
+}
+
+func (e connectError) Error() string {
+	return fmt.Sprintf("could not connect: %s", e.err)
+}
+
+func (e connectError) status() int { return http.StatusBadGateway }
+
+//privateNets are address ranges we never fetch from, unless allowPrivate is set.
+//This keeps clients from using us to reach our own network.
+var privateNets = mustParseCIDRs(
+	"0.0.0.0/8",      //"this" network
+	"10.0.0.0/8",     //private
+	"100.64.0.0/10",  //carrier grade NAT
+	"127.0.0.0/8",    //loopback
+	"169.254.0.0/16", //link local, cloud metadata lives here
+	"172.16.0.0/12",  //private
+	"192.0.0.0/24",   //IETF protocol assignments
+	"192.168.0.0/16", //private
+	"198.18.0.0/15",  //benchmarking
+	"224.0.0.0/4",    //multicast
+	"240.0.0.0/4",    //reserved and broadcast
+	"::/128",         //unspecified
+	"::1/128",        //loopback
+	"fc00::/7",       //unique local
+	"fe80::/10",      //link local
+	"ff00::/8",       //multicast
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+//isPrivateIP reports if ip is in one of privateNets
+func isPrivateIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//fetcher downloads IGC files from urls given by clients, with limits on
+//time, size and redirects, and only from public http(s) hosts.
+type fetcher struct {
+	client       *http.Client
+	timeout      time.Duration
+	maxSize      int64 //largest file we download, in bytes
+	maxRedirects int
+}
+
+//newFetcher makes a fetcher. allowPrivate turns off address blocking,
+//which is only meant for running locally.
+func newFetcher(timeout time.Duration, maxSize int64, maxRedirects int, allowPrivate bool) *fetcher {
+	f := &fetcher{timeout: timeout, maxSize: maxSize, maxRedirects: maxRedirects}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		//checked when connecting, after the name is resolved, so a
+		//hostname can't point us at a private address either
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || isPrivateIP(ip) {
+				return blockedAddressError{host}
+			}
+			return nil
+		}
+	}
+
+	f.client = &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			//no proxy, we want to check the address we really connect to
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > f.maxRedirects {
+				return tooManyRedirectsError{f.maxRedirects}
+			}
+			return checkScheme(req.URL)
+		},
+	}
+	return f
+}
+
+//checkScheme makes sure we only follow http and https urls
+func checkScheme(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return badURLError{u.String(), "only http and https are supported"}
+	}
+	if u.Host == "" {
+		return badURLError{u.String(), "no host"}
+	}
+	return nil
+}
+
+//fetch downloads the file at rawurl. Errors are always a fetchError.
+func (f *fetcher) fetch(rawurl string) ([]byte, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, badURLError{rawurl, "can not parse it"}
+	}
+	err = checkScheme(u)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := f.client.Get(u.String())
+	if err != nil {
+		return nil, f.classify(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, remoteStatusError{resp.StatusCode}
+	}
+	if resp.ContentLength > f.maxSize {
+		return nil, tooLargeError{f.maxSize}
+	}
+
+	//read one byte more than allowed, to know if there was more
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, f.maxSize+1))
+	if err != nil {
+		return nil, f.classify(err)
+	}
+	if int64(len(content)) > f.maxSize {
+		return nil, tooLargeError{f.maxSize}
+	}
+	return content, nil
+}
+
+//classify digs our own error out of what net/http wraps it in,
+//or turns the error into the fetchError that fits best.
+func (f *fetcher) classify(err error) error {
+	for {
+		switch e := err.(type) {
+		case fetchError:
+			return e
+		case *url.Error:
+			if e.Timeout() {
+				return timeoutError{f.timeout}
+			}
+			err = e.Err
+		case *net.OpError:
+			if e.Timeout() {
+				return timeoutError{f.timeout}
+			}
+			err = e.Err
+		case net.Error:
+			if e.Timeout() {
+				return timeoutError{f.timeout}
+			}
+			return connectError{err}
+		default:
+			return connectError{err}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsPrivateIP(t *testing.T) {
+	cases := []struct {
+		ip      string
+		private bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"224.0.0.1", true},
+		{"::1", true},
+		{"::", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		//IPv4 addresses written as IPv6 must not get around the IPv4 ranges
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"::ffff:169.254.169.254", true},
+		{"8.8.8.8", false},
+		{"1.1.1.1", false},
+		{"::ffff:8.8.8.8", false},
+		{"2001:4860:4860::8888", false},
+	}
+	for _, c := range cases {
+		ip := net.ParseIP(c.ip)
+		if ip == nil {
+			t.Fatalf("could not parse %s", c.ip)
+		}
+		if got := isPrivateIP(ip); got != c.private {
+			t.Errorf("isPrivateIP(%s) = %v, want %v", c.ip, got, c.private)
+		}
+	}
+}
+
+func TestFetchBlocksPrivateAddresses(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "content")
+	}))
+	defer ts.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(ts.URL, "http://"))
+
+	f := newFetcher(5*time.Second, 1000, 5, false)
+	for _, u := range []string{
+		ts.URL,
+		"http://localhost:" + port + "/",
+		"http://[::ffff:127.0.0.1]:" + port + "/",
+	} {
+		_, err := f.fetch(u)
+		if _, ok := err.(blockedAddressError); !ok {
+			t.Errorf("fetch(%s) gave %v, want a blocked address", u, err)
+			continue
+		}
+		if code := err.(fetchError).status(); code != http.StatusForbidden {
+			t.Errorf("fetch(%s) status %d, want %d", u, code, http.StatusForbidden)
+		}
+	}
+
+	//the same server is fine when private addresses are allowed
+	f = newFetcher(5*time.Second, 1000, 5, true)
+	content, err := f.fetch(ts.URL)
+	if err != nil || string(content) != "content" {
+		t.Errorf("fetch with private addresses allowed gave %q, %v", content, err)
+	}
+}
+
+//redirectServer redirects /n to /n-1, and answers /0 with content
+func redirectServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if n > 0 {
+			http.Redirect(w, r, "/"+strconv.Itoa(n-1), http.StatusFound)
+			return
+		}
+		fmt.Fprint(w, "content")
+	}))
+}
+
+func TestFetchRedirectLimit(t *testing.T) {
+	ts := redirectServer()
+	defer ts.Close()
+	f := newFetcher(5*time.Second, 1000, 3, true)
+
+	content, err := f.fetch(ts.URL + "/3")
+	if err != nil || string(content) != "content" {
+		t.Errorf("3 redirects gave %q, %v, want content", content, err)
+	}
+
+	_, err = f.fetch(ts.URL + "/4")
+	if _, ok := err.(tooManyRedirectsError); !ok {
+		t.Errorf("4 redirects gave %v, want too many redirects", err)
+	}
+}
+
+func TestFetchRedirectScheme(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+	}))
+	defer ts.Close()
+	f := newFetcher(5*time.Second, 1000, 3, true)
+
+	_, err := f.fetch(ts.URL)
+	if _, ok := err.(badURLError); !ok {
+		t.Errorf("redirect to file:// gave %v, want a bad url", err)
+	}
+}
+
+func TestFetchSizeLimit(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		body := strings.Repeat("x", size)
+		if r.URL.Query().Get("chunked") == "true" {
+			//flushing before the end means no Content-Length is sent
+			fmt.Fprint(w, body[:size/2])
+			w.(http.Flusher).Flush()
+			fmt.Fprint(w, body[size/2:])
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		fmt.Fprint(w, body)
+	}))
+	defer ts.Close()
+	f := newFetcher(5*time.Second, 100, 5, true)
+
+	for _, chunked := range []string{"false", "true"} {
+		content, err := f.fetch(ts.URL + "/?size=100&chunked=" + chunked)
+		if err != nil || len(content) != 100 {
+			t.Errorf("100 bytes, chunked=%s: gave %d bytes, %v", chunked, len(content), err)
+		}
+
+		_, err = f.fetch(ts.URL + "/?size=101&chunked=" + chunked)
+		if _, ok := err.(tooLargeError); !ok {
+			t.Errorf("101 bytes, chunked=%s: gave %v, want too large", chunked, err)
+		}
+	}
+}
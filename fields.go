@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+//trackField is one piece of data we show about a track
+type trackField struct {
+	name  string                            //as used in json and in /igc/{ID}/{field}
+	basic bool                              //shown without ?view=full
+	value func(rec trackRecord) interface{} //the data itself
+}
+
+//trackFields are all the fields we know, in the order they are shown.
+//Adding a field here makes it show up in the json and the {field} endpoint.
+var trackFields = []trackField{
+	{"H_date", true, func(rec trackRecord) interface{} { return rec.Track.Date }},
+	{"pilot", true, func(rec trackRecord) interface{} { return rec.Track.Pilot }},
+	{"glider", true, func(rec trackRecord) interface{} { return rec.Track.GliderType }},
+	{"glider_id", true, func(rec trackRecord) interface{} { return rec.Track.GliderID }},
+	{"track_length", true, func(rec trackRecord) interface{} { return rec.Stats.TrackLength }},
+	{"logger_id", true, func(rec trackRecord) interface{} { return rec.Track.UniqueID }},
+	{"crew", false, func(rec trackRecord) interface{} { return rec.Track.Crew }},
+	{"manufacturer", false, func(rec trackRecord) interface{} { return rec.Track.Manufacturer }},
+	{"firmware_version", false, func(rec trackRecord) interface{} { return rec.Track.FirmwareVersion }},
+	{"hardware_version", false, func(rec trackRecord) interface{} { return rec.Track.HardwareVersion }},
+	{"flight_recorder", false, func(rec trackRecord) interface{} { return rec.Track.FlightRecorder }},
+	{"gps", false, func(rec trackRecord) interface{} { return rec.Track.GPS }},
+	{"pressure_sensor", false, func(rec trackRecord) interface{} { return rec.Track.PressureSensor }},
+	{"competition_id", false, func(rec trackRecord) interface{} { return rec.Track.CompetitionID }},
+	{"competition_class", false, func(rec trackRecord) interface{} { return rec.Track.CompetitionClass }},
+	{"gps_datum", false, func(rec trackRecord) interface{} { return rec.Track.GPSDatum }},
+	{"fix_accuracy", false, func(rec trackRecord) interface{} { return rec.Track.FixAccuracy }},
+	{"timezone", false, func(rec trackRecord) interface{} { return rec.Track.Timezone }},
+}
+
+//findField gives the field with the given name
+func findField(name string) (trackField, bool) {
+	for _, f := range trackFields {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return trackField{}, false
+}
+
+//fieldNames lists the names of all fields
+func fieldNames() []string {
+	names := make([]string, len(trackFields))
+	for i, f := range trackFields {
+		names[i] = f.name
+	}
+	return names
+}
+
+//marshalFields makes a json object of the fields of rec, in trackFields order.
+//Use rec.view to choose if ground time is included.
+//Only basic fields unless full is set.
+func marshalFields(rec trackRecord, full bool) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	first := true
+	for _, f := range trackFields {
+		if !f.basic && !full {
+			continue
+		}
+		js, err := json.Marshal(f.value(rec))
+		if err != nil {
+			return nil, err
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		fmt.Fprintf(&buf, "%q:", f.name)
+		buf.Write(js)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+//UnknownField is the answer when asking for a field we don't have
+type UnknownField struct {
+	Error  string   `json:"error"`
+	Fields []string `json:"fields"` //the names that would work
+}
+
+//writes 404 with a json listing the fields there are
+func unknownField(w http.ResponseWriter, name string) {
+	js, err := json.Marshal(UnknownField{fmt.Sprintf("Unknown field %q", name), fieldNames()})
+	if err != nil {
+		str := fmt.Sprintf("Marshal error: %s", err)
+		errorHandler(w, http.StatusInternalServerError, str)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	w.Write(js)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//storedSummary is written as json next to the raw IGC file
+type storedSummary struct {
+	ID         string     `json:"id"`
+	Registered time.Time  `json:"registered"`
+	Deleted    *time.Time `json:"deleted,omitempty"` //set while soft deleted
+	IDdata
+}
+
+//fileStore is a TrackStore that keeps every track on disk in dir,
+//so they survive restarts. Each track is two files: <id>.igc with the raw
+//content and <id>.json with the summary. The json is written last, so a
+//track only counts as registered once its summary is in place.
+//Reads are served from memory.
+type fileStore struct {
+	dir   string
+	mu    sync.Mutex //serializes writes to dir
+	cache *memoryStore
+}
+
+//newFileStore makes a fileStore in dir and loads any tracks already there
+func newFileStore(dir string) (*fileStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	f := &fileStore{dir: dir, cache: newMemoryStore()}
+	err = f.load()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+//load reads every stored track in dir into memory, oldest first
+func (f *fileStore) load() error {
+	names, err := filepath.Glob(filepath.Join(f.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	var recs []trackRecord
+	for _, name := range names {
+		rec, err := f.read(name)
+		if err != nil {
+			//one broken track should not keep the rest from loading
+			log.Printf("Skipping %s: %s", name, err)
+			continue
+		}
+		recs = append(recs, rec)
+	}
+
+	//keep the order tracks were registered in
+	sortRecords(recs)
+	for _, rec := range recs {
+		err = f.cache.Put(rec)
+		if err != nil {
+			log.Printf("Skipping %s: %s", rec.ID, err)
+		}
+	}
+	log.Printf("Loaded %d tracks from %s", len(recs), f.dir)
+	return nil
+}
+
+//read loads a single track from its summary file and the IGC file beside it
+func (f *fileStore) read(summaryFile string) (trackRecord, error) {
+	js, err := ioutil.ReadFile(summaryFile)
+	if err != nil {
+		return trackRecord{}, err
+	}
+	var sum storedSummary
+	err = json.Unmarshal(js, &sum)
+	if err != nil {
+		return trackRecord{}, err
+	}
+
+	raw, err := ioutil.ReadFile(strings.TrimSuffix(summaryFile, ".json") + ".igc")
+	if err != nil {
+		return trackRecord{}, err
+	}
+	track, err := parseIGC(raw)
+	if err != nil {
+		return trackRecord{}, err
+	}
+	rec := newTrackRecord(sum.ID, track, raw, sum.Registered)
+	if sum.Deleted != nil {
+		rec.Deleted = *sum.Deleted
+	}
+	return rec, nil
+}
+
+//writeSummary writes the summary file of rec
+func (f *fileStore) writeSummary(rec trackRecord) error {
+	sum := storedSummary{ID: rec.ID, Registered: rec.Registered, IDdata: newIDdata(rec)}
+	if !rec.Deleted.IsZero() {
+		sum.Deleted = &rec.Deleted
+	}
+	js, err := json.Marshal(sum)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.path(rec.ID, ".json"), js)
+}
+
+//path gives the file for id with the given extension.
+//IDs are escaped so they can't point outside of dir.
+func (f *fileStore) path(id, ext string) string {
+	return filepath.Join(f.dir, url.PathEscape(id)+ext)
+}
+
+func (f *fileStore) Put(rec trackRecord) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if old, ok := f.cache.getAny(rec.ID); ok {
+		if !old.Deleted.IsZero() {
+			return errTrackDeleted
+		}
+		return errAlreadyRegistered
+	}
+
+	err := writeFileAtomic(f.path(rec.ID, ".igc"), rec.Raw)
+	if err != nil {
+		return err
+	}
+	err = f.writeSummary(rec)
+	if err != nil {
+		os.Remove(f.path(rec.ID, ".igc"))
+		return err
+	}
+	return f.cache.Put(rec)
+}
+
+func (f *fileStore) Get(id string) (trackRecord, error) {
+	return f.cache.Get(id)
+}
+
+func (f *fileStore) List() []string {
+	return f.cache.List()
+}
+
+func (f *fileStore) Delete(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.cache.getAny(id); !ok {
+		return errTrackNotFound
+	}
+	//summary first, so a half deleted track is not loaded again
+	err := os.Remove(f.path(id, ".json"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(f.path(id, ".igc"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return f.cache.Delete(id)
+}
+
+func (f *fileStore) Exists(id string) bool {
+	return f.cache.Exists(id)
+}
+
+func (f *fileStore) SoftDelete(id string, at time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rec, err := f.cache.Get(id)
+	if err != nil {
+		return err
+	}
+	rec.Deleted = at
+	err = f.writeSummary(rec)
+	if err != nil {
+		return err
+	}
+	return f.cache.SoftDelete(id, at)
+}
+
+func (f *fileStore) Restore(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rec, ok := f.cache.getAny(id)
+	if !ok || rec.Deleted.IsZero() {
+		return errTrackNotFound
+	}
+	rec.Deleted = time.Time{}
+	err := f.writeSummary(rec)
+	if err != nil {
+		return err
+	}
+	return f.cache.Restore(id)
+}
+
+func (f *fileStore) ListDeleted() []trackRecord {
+	return f.cache.ListDeleted()
+}
+
+//writeFileAtomic writes data to a temporary file and renames it into place,
+//so name either has the old content or all of the new content.
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return err
+	}
+	//clean up if anything below fails. Harmless after the rename.
+	defer os.Remove(tmp.Name())
+
+	err = tmp.Chmod(0644)
+	if err == nil {
+		_, err = tmp.Write(data)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("writing %s: %s", name, err)
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	igc "github.com/marni/goigc"
+)
+
+//thresholds for telling flight from ground time
+const (
+	takeoffSpeed = 30.0             //km/h over ground, faster than taxiing or GPS jitter
+	takeoffClimb = 1.0              //m/s up or down, for winch launches and hovering in wind
+	detectHold   = 30 * time.Second //how long it must last to count
+)
+
+//flightInterval is the part of a track spent in the air
+type flightInterval struct {
+	Start, End int  //index of first and last point in flight
+	Detected   bool //false if we could not find takeoff and landing, and use the whole track
+}
+
+//detectFlight finds where pts go from ground to flight and back. Points
+//count as flying when ground speed or climb rate over rateWindow is above
+//the thresholds, and flight starts and ends with detectHold of that.
+func detectFlight(pts []igc.Point, times []time.Time) flightInterval {
+	whole := flightInterval{0, len(pts) - 1, false}
+	if len(pts) < 2 {
+		whole.End = 0
+		return whole
+	}
+
+	//ahead[i] is the first point at least rateWindow after point i
+	ahead := make([]int, len(pts))
+	moving := make([]bool, len(pts))
+	j := 0
+	for i := range pts {
+		for j < len(pts) && times[j].Sub(times[i]) < rateWindow {
+			j++
+		}
+		ahead[i] = j
+		if j == len(pts) {
+			continue
+		}
+		dt := times[j].Sub(times[i]).Seconds()
+		dist := 0.0
+		for k := i; k < j; k++ {
+			dist += pts[k].Distance(pts[k+1])
+		}
+		speed := dist / dt * 3600
+		climb := float64(pts[j].PressureAltitude-pts[i].PressureAltitude) / dt
+		moving[i] = speed >= takeoffSpeed || climb >= takeoffClimb || -climb >= takeoffClimb
+	}
+
+	//takeoff: start of the first moving run lasting detectHold
+	start := -1
+	for i, runStart := 0, -1; i < len(pts); i++ {
+		if !moving[i] {
+			runStart = -1
+			continue
+		}
+		if runStart < 0 {
+			runStart = i
+		}
+		if times[i].Sub(times[runStart]) >= detectHold {
+			start = runStart
+			break
+		}
+	}
+
+	//landing: end of the last moving run lasting detectHold. The window
+	//starting at the run's last point was still moving, so it ends where that window ends.
+	end := -1
+	for i, runEnd := len(pts)-1, -1; i >= 0; i-- {
+		if !moving[i] {
+			runEnd = -1
+			continue
+		}
+		if runEnd < 0 {
+			runEnd = i
+		}
+		if times[runEnd].Sub(times[i]) >= detectHold {
+			end = ahead[runEnd]
+			break
+		}
+	}
+
+	if start < 0 || end < 0 || end <= start {
+		return whole
+	}
+	if end > len(pts)-1 {
+		end = len(pts) - 1
+	}
+	return flightInterval{start, end, true}
+}
+
+//view gives rec as shown to clients: flight time only, or with ground time
+//before takeoff and after landing when includeGround is set
+func (rec trackRecord) view(includeGround bool) trackRecord {
+	if includeGround {
+		rec.Stats = rec.AllStats
+	}
+	return rec
+}
+
+//flightPoints gives the points of rec in flight and the time of each,
+//or all of them with includeGround
+func (rec trackRecord) flightPoints(includeGround bool) ([]igc.Point, []time.Time) {
+	pts, times := rec.Track.Points, pointTimes(rec.Track)
+	if includeGround || len(pts) == 0 {
+		return pts, times
+	}
+	return pts[rec.Flight.Start : rec.Flight.End+1], times[rec.Flight.Start : rec.Flight.End+1]
+}
+
+//includeGround reports if the client asked for ground time too, with ?include_ground=true
+func includeGround(r *http.Request) bool {
+	return r.URL.Query().Get("include_ground") == "true"
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"math"
+
+	igc "github.com/marni/goigc"
+)
+
+//bearing is the direction from a to b, in degrees clockwise from north (0 to 360)
+func bearing(a, b igc.Point) float64 {
+	lat1, lat2 := a.Lat.Radians(), b.Lat.Radians()
+	dLng := b.Lng.Radians() - a.Lng.Radians()
+	y := math.Sin(dLng) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLng)
+	return normalizeBearing(math.Atan2(y, x) * 180 / math.Pi)
+}
+
+//normalizeBearing puts deg between 0 and 360
+func normalizeBearing(deg float64) float64 {
+	deg = math.Mod(deg, 360)
+	if deg < 0 {
+		deg += 360
+	}
+	return deg
+}
+
+//turnAngle is how far to turn from heading a to heading b, in degrees
+//from -180 (left) to 180 (right)
+func turnAngle(a, b float64) float64 {
+	return math.Mod(b-a+540, 360) - 180
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//geoJSONType is the media type of GeoJSON, RFC 7946
+const geoJSONType = "application/geo+json"
+
+//GeoFeature is a track as a GeoJSON Feature
+type GeoFeature struct {
+	Type       string          `json:"type"` //always Feature
+	ID         string          `json:"id"`
+	Geometry   GeoLineString   `json:"geometry"`
+	Properties json.RawMessage `json:"properties"` //the track fields, and coordTimes
+}
+
+//GeoLineString is a GeoJSON LineString with altitude
+type GeoLineString struct {
+	Type        string       `json:"type"`        //always LineString
+	Coordinates [][3]float64 `json:"coordinates"` //longitude, latitude, altitude in metres
+}
+
+//GeoCollection is tracks as a GeoJSON FeatureCollection, without the features.
+//Those are written after it one at a time, so a page never has to fit in memory.
+type GeoCollection struct {
+	Type  string `json:"type"`           //always FeatureCollection
+	Total int    `json:"total"`          //tracks matching the filters, on all pages
+	Next  string `json:"next,omitempty"` //give as after= to get the next page
+}
+
+//acceptsGeoJSON reports if the client asked for GeoJSON in its Accept header
+func acceptsGeoJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediatype, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err == nil && mediatype == geoJSONType {
+			return true
+		}
+	}
+	return false
+}
+
+//newGeoFeature makes a Feature of rec. Properties are the fields as in
+//marshalFields, with the time of every point as coordTimes.
+func newGeoFeature(rec trackRecord, full bool, opts exportOptions) (GeoFeature, error) {
+	t := rec.Track
+	f := GeoFeature{
+		Type: "Feature",
+		ID:   rec.ID,
+		Geometry: GeoLineString{
+			Type:        "LineString",
+			Coordinates: make([][3]float64, len(t.Points)),
+		},
+	}
+	for i, p := range t.Points {
+		f.Geometry.Coordinates[i] = [3]float64{p.Lng.Degrees(), p.Lat.Degrees(), float64(opts.altitude(p))}
+	}
+
+	props, err := marshalFields(rec, full)
+	if err != nil {
+		return f, err
+	}
+	times := pointTimes(t)
+	if times == nil {
+		times = []time.Time{}
+	}
+	js, err := json.Marshal(times)
+	if err != nil {
+		return f, err
+	}
+	//add coordTimes as the last property
+	props = bytes.TrimSuffix(props, []byte("}"))
+	if len(props) > 1 {
+		props = append(props, ',')
+	}
+	props = append(props, `"coordTimes":`...)
+	props = append(props, js...)
+	f.Properties = append(props, '}')
+	return f, nil
+}
+
+//writeGeoJSON writes v with the GeoJSON media type
+func writeGeoJSON(w http.ResponseWriter, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		str := fmt.Sprintf("Marshal error: %s", err)
+		errorHandler(w, http.StatusInternalServerError, str)
+		return
+	}
+	w.Header().Set("Content-Type", geoJSONType)
+	w.Write(js)
+}
+
+//writes a page of tracks as a FeatureCollection. Takes the same parameters
+//as the track listing, plus ?view= and ?altitude=
+func (s *server) handlAPIgeojson(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	lq, err := parseListQuery(q)
+	if err != nil {
+		errorHandler(w, http.StatusBadRequest, fmt.Sprintf("Error: %s", err))
+		return
+	}
+	view := q.Get("view")
+	if view != "" && view != "basic" && view != "full" {
+		errorHandler(w, http.StatusBadRequest, "Error: view must be basic or full")
+		return
+	}
+	opts, err := parseExportOptions(q)
+	if err != nil {
+		errorHandler(w, http.StatusBadRequest, fmt.Sprintf("Error: %s", err))
+		return
+	}
+
+	page := s.trackPage(lq)
+	head, err := json.Marshal(GeoCollection{"FeatureCollection", page.Total, page.Next})
+	if err != nil {
+		str := fmt.Sprintf("Marshal error: %s", err)
+		errorHandler(w, http.StatusInternalServerError, str)
+		return
+	}
+
+	//every track has all its points, so features are made and written one by one
+	w.Header().Set("Content-Type", geoJSONType)
+	w.Write(bytes.TrimSuffix(head, []byte("}")))
+	io.WriteString(w, `,"features":[`)
+	written := 0
+	for _, id := range page.IDs {
+		rec, err := s.store.Get(id)
+		if err != nil {
+			continue //deleted while we were looking
+		}
+		if written > 0 {
+			io.WriteString(w, ",")
+		}
+		err = writeGeoFeature(w, rec.view(includeGround(r)), view == "full", opts)
+		if err != nil {
+			//too late to change the status, so the client gets cut off json
+			log.Printf("GeoJSON error: %s", err)
+			return
+		}
+		written++
+	}
+	io.WriteString(w, "]}")
+}
+
+//writeGeoFeature writes rec to w as a Feature, like newGeoFeature makes it
+func writeGeoFeature(w io.Writer, rec trackRecord, full bool, opts exportOptions) error {
+	f, err := newGeoFeature(rec, full, opts)
+	if err != nil {
+		return err
+	}
+	js, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(js)
+	return err
+}
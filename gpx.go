@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"time"
+)
+
+//gpx is a GPX 1.1 document, see http://www.topografix.com/GPX/1/1/
+type gpx struct {
+	XMLName   xml.Name    `xml:"http://www.topografix.com/GPX/1/1 gpx"`
+	Version   string      `xml:"version,attr"`
+	Creator   string      `xml:"creator,attr"`
+	Metadata  gpxMetadata `xml:"metadata"`
+	Waypoints []gpxPoint  `xml:"wpt"`
+	Track     gpxTrack    `xml:"trk"`
+}
+
+type gpxMetadata struct {
+	Name   string     `xml:"name,omitempty"`
+	Desc   string     `xml:"desc,omitempty"`
+	Author *gpxPerson `xml:"author,omitempty"`
+	Time   time.Time  `xml:"time"`
+}
+
+type gpxPerson struct {
+	Name string `xml:"name"`
+}
+
+type gpxTrack struct {
+	Name     string       `xml:"name,omitempty"`
+	Src      string       `xml:"src,omitempty"`  //the flight recorder
+	Type     string       `xml:"type,omitempty"` //the glider
+	Segments []gpxSegment `xml:"trkseg"`
+}
+
+type gpxSegment struct {
+	Points []gpxPoint `xml:"trkpt"`
+}
+
+//gpxPoint is a wpt or trkpt, which are the same type in GPX
+type gpxPoint struct {
+	Lat  float64    `xml:"lat,attr"`
+	Lon  float64    `xml:"lon,attr"`
+	Ele  *int64     `xml:"ele,omitempty"`
+	Time *time.Time `xml:"time,omitempty"`
+	Name string     `xml:"name,omitempty"`
+	Type string     `xml:"type,omitempty"`
+}
+
+//writeGPX writes rec as a GPX track, with the declared task as waypoints
+func writeGPX(w io.Writer, rec trackRecord, opts exportOptions) error {
+	t := rec.Track
+	doc := gpx{
+		Version: "1.1",
+		Creator: "igcinfo",
+		Metadata: gpxMetadata{
+			Name: trackTitle(t),
+			Desc: trackDescription(t),
+			Time: t.Date,
+		},
+		Waypoints: []gpxPoint{},
+		Track: gpxTrack{
+			Name: trackTitle(t),
+			Src:  t.FlightRecorder,
+			Type: t.GliderType,
+		},
+	}
+	if t.Pilot != "" {
+		doc.Metadata.Author = &gpxPerson{t.Pilot}
+	}
+	for _, wp := range taskWaypoints(t.Task) {
+		doc.Waypoints = append(doc.Waypoints, gpxPoint{
+			Lat:  wp.Lat.Degrees(),
+			Lon:  wp.Lng.Degrees(),
+			Name: wp.name,
+			Type: wp.kind,
+		})
+	}
+
+	seg := gpxSegment{}
+	times := pointTimes(t)
+	for i, p := range t.Points {
+		ele := opts.altitude(p)
+		seg.Points = append(seg.Points, gpxPoint{
+			Lat:  p.Lat.Degrees(),
+			Lon:  p.Lng.Degrees(),
+			Ele:  &ele,
+			Time: &times[i],
+		})
+	}
+	doc.Track.Segments = []gpxSegment{seg}
+
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", " ")
+	err = enc.Encode(doc)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
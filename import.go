@@ -0,0 +1,124 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+//ImportEntry is one file in an imported zip archive
+type ImportEntry struct {
+	Name   string `json:"name"`
+	ID     string `json:"id,omitempty"`     //the track, for imported and duplicates
+	Reason string `json:"reason,omitempty"` //why it was skipped or failed
+}
+
+//ImportManifest tells what happened to every file in an imported zip archive
+type ImportManifest struct {
+	Imported []ImportEntry `json:"imported"`
+	Skipped  []ImportEntry `json:"skipped"`
+	Failed   []ImportEntry `json:"failed"`
+}
+
+//registers every .igc file in a zip archive. The archive is either the whole
+//body, or uploaded as a multipart form in the "file" field.
+func (s *server) handlAPIimport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		str := fmt.Sprintf("Sorry, only POST method is supported.")
+		errorHandler(w, http.StatusBadRequest, str)
+		return
+	}
+
+	//refuse bodies that are too big before reading anything
+	if !limitBody(w, r, s.maxImport) {
+		return
+	}
+
+	mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	raw, err := readUpload(r, mediatype)
+	if err != nil {
+		bodyError(w, "Upload error", err)
+		return
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(raw), int64(len(raw)))
+	if err != nil {
+		str := fmt.Sprintf("Error: not a zip archive: %s", err)
+		errorHandler(w, http.StatusBadRequest, str)
+		return
+	}
+
+	writeJSON(w, s.importZip(archive))
+}
+
+//importZip registers the .igc files in archive one by one
+func (s *server) importZip(archive *zip.Reader) ImportManifest {
+	//empty lists rather than null in the json
+	m := ImportManifest{[]ImportEntry{}, []ImportEntry{}, []ImportEntry{}}
+
+	for _, f := range archive.File {
+		entry := ImportEntry{Name: f.Name}
+		base := path.Base(f.Name)
+
+		switch {
+		case f.FileInfo().IsDir():
+			continue //folders are not worth mentioning
+		case !strings.EqualFold(path.Ext(base), ".igc"):
+			entry.Reason = "not an .igc file"
+			m.Skipped = append(m.Skipped, entry)
+			continue
+		case strings.HasPrefix(f.Name, "__MACOSX/") || strings.HasPrefix(base, "._"):
+			entry.Reason = "resource fork, not a track"
+			m.Skipped = append(m.Skipped, entry)
+			continue
+		}
+
+		content, err := s.readZipEntry(f)
+		if err != nil {
+			entry.Reason = err.Error()
+			m.Failed = append(m.Failed, entry)
+			continue
+		}
+
+		entry.ID, err = s.register(content)
+		switch {
+		case err == nil:
+			m.Imported = append(m.Imported, entry)
+		case err == errAlreadyRegistered || err == errTrackDeleted:
+			entry.Reason = err.Error()
+			m.Skipped = append(m.Skipped, entry)
+		default:
+			entry.Reason = err.Error()
+			m.Failed = append(m.Failed, entry)
+		}
+	}
+	return m
+}
+
+//readZipEntry unpacks f, but never more than s.maxUpload bytes of it,
+//so a tiny archive can't fill our memory.
+func (s *server) readZipEntry(f *zip.File) ([]byte, error) {
+	if f.UncompressedSize64 > uint64(s.maxUpload) {
+		return nil, fmt.Errorf("file is larger than %d bytes", s.maxUpload)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	content, err := ioutil.ReadAll(io.LimitReader(rc, s.maxUpload+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > s.maxUpload {
+		return nil, fmt.Errorf("file is larger than %d bytes", s.maxUpload)
+	}
+	return content, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	igc "github.com/marni/goigc"
+)
+
+//defaultMaxUpload is how many bytes a POST body can have unless MAX_UPLOAD_SIZE says otherwise
+const defaultMaxUpload = 10 << 20
+
+//defaultMaxImport is how many bytes a zip archive can have unless IMPORT_MAX_SIZE says otherwise
+const defaultMaxImport = 50 << 20
+
+//parseError means we got content, but it was not a valid IGC file
+type parseError struct {
+	err error
+}
+
+func (e parseError) Error() string {
+	return e.err.Error()
+}
+
+//register parses raw IGC content and adds the track to our store.
+//Returns the ID the track got, also when it failed with errAlreadyRegistered
+//or errTrackDeleted.
+func (s *server) register(raw []byte) (string, error) {
+	track, err := parseIGC(raw)
+	if err != nil {
+		return "", err
+	}
+	//goigc is happy with an empty or header only file, but there is no track in it
+	if len(track.Points) == 0 {
+		return "", parseError{errors.New("no fixes (B records) in the file")}
+	}
+
+	//the ID comes from the content, so the same flight always gets the same ID
+	//and it is a duplicate no matter who uploads it or from where
+	id := contentID(raw)
+	err = s.store.Put(newTrackRecord(id, track, raw, time.Now()))
+	if err == errAlreadyRegistered || err == errTrackDeleted {
+		return id, err
+	} else if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+//parseIGC parses raw IGC content. goigc panics on some broken files, and we
+//parse in job and batch workers where nothing would catch it, so a panic is a parseError too.
+func parseIGC(raw []byte) (track igc.Track, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = parseError{fmt.Errorf("malformed IGC content: %v", r)}
+		}
+	}()
+	track, err = igc.Parse(string(raw))
+	if err != nil {
+		return track, parseError{err}
+	}
+	return track, nil
+}
+
+//registerURL fetches the IGC file at url and registers it
+func (s *server) registerURL(url string) (string, error) {
+	raw, err := s.fetcher.fetch(url)
+	if err != nil {
+		return "", err
+	}
+	return s.register(raw)
+}
+
+//ingestError gives the status and message to answer with when registering failed
+func ingestError(err error) (int, string) {
+	switch e := err.(type) {
+	case fetchError:
+		return e.status(), fmt.Sprintf("Problem reading the track: %s", e)
+	case parseError:
+		return http.StatusBadRequest, fmt.Sprintf("Problem reading the track: %s", e)
+	}
+	if err == errAlreadyRegistered {
+		return http.StatusBadRequest, fmt.Sprintf("Error: %s", err)
+	} else if err == errTrackDeleted {
+		return http.StatusConflict, fmt.Sprintf("Error: %s", err)
+	}
+	return http.StatusInternalServerError, fmt.Sprintf("Store error: %s", err)
+}
+
+//contentID makes a track ID from a hash of the normalized IGC content.
+//Line endings, surrounding whitespace and empty lines do not change the ID.
+func contentID(raw []byte) string {
+	h := sha256.New()
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		io.WriteString(h, line)
+		io.WriteString(h, "\n")
+	}
+	//first 10 bytes are plenty to tell flights apart, and keep urls short
+	return hex.EncodeToString(h.Sum(nil)[:10])
+}
+
+//isUpload reports if a POST body with this media type is the IGC file itself
+func isUpload(mediatype string) bool {
+	switch mediatype {
+	case "multipart/form-data", "text/plain", "application/octet-stream":
+		return true
+	}
+	return false
+}
+
+//readUpload gets the uploaded IGC content from r. Multipart forms must have
+//the file in the "file" field, otherwise the whole body is the file.
+func readUpload(r *http.Request, mediatype string) ([]byte, error) {
+	if mediatype != "multipart/form-data" {
+		return ioutil.ReadAll(r.Body)
+	}
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
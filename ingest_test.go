@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//panicIGC makes goigc panic in parseK, slicing past the end of the K record
+const panicIGC = "AXXX123\nJ010812HDT\nK120000\n"
+
+//newTestServer makes a server with memory storage and small limits
+func newTestServer() *server {
+	index := newSearchIndex()
+	return &server{
+		store:        newIndexedStore(newMemoryStore(), index),
+		index:        index,
+		fetcher:      newFetcher(time.Second, defaultMaxUpload, 5, false),
+		jobs:         newJobQueue(1, 10),
+		optimized:    newOptimizeCache(),
+		maxUpload:    defaultMaxUpload,
+		maxImport:    defaultMaxImport,
+		batchMax:     10,
+		batchWorkers: 2,
+		deleteGrace:  time.Hour,
+	}
+}
+
+func TestRegisterPanickingContent(t *testing.T) {
+	s := newTestServer()
+	_, err := s.register([]byte(panicIGC))
+	if _, ok := err.(parseError); !ok {
+		t.Fatalf("register gave %v, want a parseError", err)
+	}
+	if code, _ := ingestError(err); code != http.StatusBadRequest {
+		t.Errorf("status %d, want %d", code, http.StatusBadRequest)
+	}
+	if ids := s.store.List(); len(ids) != 0 {
+		t.Errorf("stored %v, want nothing", ids)
+	}
+}
+
+func TestAsyncUploadPanickingContent(t *testing.T) {
+	s := newTestServer()
+	ts := httptest.NewServer(newRouter(s))
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/igcinfo/api/igc?async=true", "text/plain", strings.NewReader(panicIGC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var job Job
+	err = json.NewDecoder(resp.Body).Decode(&job)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("upload gave %d, %v, want 202 and a job", resp.StatusCode, err)
+	}
+
+	//a panic in the worker would have taken the test down with it
+	for i := 0; i < 100 && job.Finished == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		job, err = s.jobs.get(job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if job.Status != jobFailed {
+		t.Errorf("job %s, want %s", job.Status, jobFailed)
+	}
+}
+
+func TestRegisterWithoutFixes(t *testing.T) {
+	s := newTestServer()
+	for _, raw := range []string{"", "AXXX001\nHFDTE020718\nHFPLTPILOTINCHARGE: Test Pilot\n"} {
+		_, err := s.register([]byte(raw))
+		if _, ok := err.(parseError); !ok {
+			t.Errorf("register(%q) gave %v, want a parseError", raw, err)
+		}
+	}
+	if ids := s.store.List(); len(ids) != 0 {
+		t.Errorf("stored %v, want nothing", ids)
+	}
+}
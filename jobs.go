@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+//errQueueFull is returned by submit when every worker is busy and the queue is full
+var errQueueFull = errors.New("Too many jobs waiting, try again later")
+
+//errJobNotFound is returned when no job has the given ID
+var errJobNotFound = errors.New("Did not find job")
+
+//errJobCancelled is returned by work that stopped because its job was cancelled
+var errJobCancelled = errors.New("Job was cancelled")
+
+//the states a job goes through
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+//how long finished jobs can be looked up
+const jobRetention = time.Hour
+
+//Job is the status of a background task, like an asynchronous registration, as we show it to clients
+type Job struct {
+	ID       string     `json:"job_id"`
+	Status   string     `json:"status"`             //queued, running, succeeded, failed or cancelled
+	TrackID  string     `json:"track_id,omitempty"` //set when succeeded
+	Error    string     `json:"error,omitempty"`    //set when failed
+	Created  time.Time  `json:"created"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+//jobWork does the actual work and gives the ID of the track it was about.
+//Long running work should give up with errJobCancelled once cancel is closed.
+type jobWork func(cancel <-chan struct{}) (string, error)
+
+type queuedJob struct {
+	id     string
+	work   jobWork
+	cancel chan struct{}
+}
+
+//jobQueue runs work in the background on a fixed number of workers
+type jobQueue struct {
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	cancels map[string]chan struct{} //of jobs that haven't finished
+	queue   chan queuedJob
+}
+
+//newJobQueue starts workers goroutines, and lets up to size jobs wait for them
+func newJobQueue(workers, size int) *jobQueue {
+	q := &jobQueue{
+		jobs:    make(map[string]*Job),
+		cancels: make(map[string]chan struct{}),
+		queue:   make(chan queuedJob, size),
+	}
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+	return q
+}
+
+//submit queues work and returns the job it will be tracked as
+func (q *jobQueue) submit(work jobWork) (Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return Job{}, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.prune()
+	job := &Job{ID: id, Status: jobQueued, Created: time.Now()}
+	cancel := make(chan struct{})
+	select {
+	case q.queue <- queuedJob{id, work, cancel}:
+		q.jobs[id] = job
+		q.cancels[id] = cancel
+		return *job, nil
+	default:
+		return Job{}, errQueueFull
+	}
+}
+
+//get returns a copy of the job with the given id
+func (q *jobQueue) get(id string) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, errJobNotFound
+	}
+	return *job, nil
+}
+
+//cancel stops the job with the given id, and returns what it looks like now.
+//Queued jobs will never run. Running jobs stop when their work notices.
+//Finished jobs are left as they are.
+func (q *jobQueue) cancel(id string) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, errJobNotFound
+	}
+	if cancel, ok := q.cancels[id]; ok {
+		close(cancel)
+		delete(q.cancels, id)
+		if job.Status == jobQueued {
+			q.finishLocked(job, jobCancelled, "", nil)
+		}
+	}
+	return *job, nil
+}
+
+//worker runs queued jobs until the program ends
+func (q *jobQueue) worker() {
+	for qj := range q.queue {
+		if !q.start(qj.id) {
+			continue //cancelled while queued
+		}
+		trackID, err := qj.work(qj.cancel)
+		switch {
+		case err == errJobCancelled:
+			q.finish(qj.id, jobCancelled, "", nil)
+		case err != nil:
+			q.finish(qj.id, jobFailed, "", err)
+		default:
+			q.finish(qj.id, jobSucceeded, trackID, nil)
+		}
+	}
+}
+
+//start marks a queued job as running. False if it was cancelled.
+func (q *jobQueue) start(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok || job.Status != jobQueued {
+		return false
+	}
+	job.Status = jobRunning
+	return true
+}
+
+//finish sets the final status of the job with the given id
+func (q *jobQueue) finish(id, status, trackID string, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return
+	}
+	q.finishLocked(job, status, trackID, err)
+}
+
+//finishLocked sets the final status of job. Needs q.mu.
+func (q *jobQueue) finishLocked(job *Job, status, trackID string, err error) {
+	job.Status = status
+	job.TrackID = trackID
+	if err != nil {
+		job.Error = err.Error()
+	}
+	now := time.Now()
+	job.Finished = &now
+	delete(q.cancels, job.ID)
+}
+
+//prune forgets jobs that finished more than jobRetention ago. Needs q.mu.
+func (q *jobQueue) prune() {
+	for id, job := range q.jobs {
+		if job.Finished != nil && time.Since(*job.Finished) > jobRetention {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+//newJobID makes a random ID for a job
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
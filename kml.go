@@ -0,0 +1,272 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	igc "github.com/marni/goigc"
+)
+
+//kmlStyle is how one band of climb rate or speed is drawn
+type kmlStyle struct {
+	id    string
+	upTo  float64 //the band holds values below this
+	color string  //aabbggrr, as KML wants it
+}
+
+//the bands the track is colored in, slowest or most sinking first.
+//The last band takes everything above.
+var (
+	climbStyles = []kmlStyle{
+		{"sink-strong", -3, "ffff0000"},
+		{"sink", -1, "ffffaa00"},
+		{"level", 1, "ff00ff00"},
+		{"climb", 3, "ff00ffff"},
+		{"climb-strong", 0, "ff0000ff"},
+	}
+	speedStyles = []kmlStyle{
+		{"speed-50", 50, "ffff0000"},
+		{"speed-100", 100, "ffffaa00"},
+		{"speed-150", 150, "ff00ff00"},
+		{"speed-200", 200, "ff00ffff"},
+		{"speed-max", 0, "ff0000ff"},
+	}
+	plainStyle = kmlStyle{"track", 0, "ff00aaff"}
+)
+
+type kml struct {
+	XMLName  xml.Name    `xml:"http://www.opengis.net/kml/2.2 kml"`
+	Document kmlDocument `xml:"Document"`
+}
+
+type kmlDocument struct {
+	Name        string         `xml:"name"`
+	Description string         `xml:"description,omitempty"`
+	Styles      []kmlStyleElem `xml:"Style"`
+	Folders     []kmlFolder    `xml:"Folder"`
+}
+
+type kmlStyleElem struct {
+	ID    string `xml:"id,attr"`
+	Color string `xml:"LineStyle>color"`
+	Width int    `xml:"LineStyle>width"`
+}
+
+type kmlFolder struct {
+	Name       string         `xml:"name"`
+	Placemarks []kmlPlacemark `xml:"Placemark"`
+}
+
+type kmlPlacemark struct {
+	Name        string         `xml:"name,omitempty"`
+	Description string         `xml:"description,omitempty"`
+	When        *time.Time     `xml:"TimeStamp>when,omitempty"`
+	StyleURL    string         `xml:"styleUrl,omitempty"`
+	Point       *kmlPoint      `xml:"Point,omitempty"`
+	LineString  *kmlLineString `xml:"LineString,omitempty"`
+}
+
+type kmlPoint struct {
+	AltitudeMode string `xml:"altitudeMode"`
+	Coordinates  string `xml:"coordinates"`
+}
+
+type kmlLineString struct {
+	Extrude      int    `xml:"extrude"`
+	AltitudeMode string `xml:"altitudeMode"`
+	Coordinates  string `xml:"coordinates"`
+}
+
+//kmlCoordinates writes points as KML wants them, lon,lat,alt separated by spaces
+func kmlCoordinates(pts []igc.Point, opts exportOptions) string {
+	var b strings.Builder
+	for i, p := range pts {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%.6f,%.6f,%d", p.Lng.Degrees(), p.Lat.Degrees(), opts.altitude(p))
+	}
+	return b.String()
+}
+
+//kmlPlace is a placemark on a single point of the track
+func kmlPlace(name, desc string, p igc.Point, t time.Time, opts exportOptions) kmlPlacemark {
+	return kmlPlacemark{
+		Name:        name,
+		Description: desc,
+		When:        &t,
+		Point:       &kmlPoint{"absolute", kmlCoordinates([]igc.Point{p}, opts)},
+	}
+}
+
+//styleFor finds the band v is in
+func styleFor(styles []kmlStyle, v float64) kmlStyle {
+	for _, s := range styles[:len(styles)-1] {
+		if v < s.upTo {
+			return s
+		}
+	}
+	return styles[len(styles)-1]
+}
+
+//colorValues is the climb rate in m/s or ground speed in km/h at each fix,
+//measured over rateWindow ahead, or over the last rateWindow at the end of the track
+func colorValues(pts []igc.Point, times []time.Time, color string) []float64 {
+	vals := make([]float64, len(pts))
+	j := 0
+	for i := range pts {
+		for j < len(pts)-1 && times[j].Sub(times[i]) < rateWindow {
+			j++
+		}
+		a, b := i, j
+		for a > 0 && times[b].Sub(times[a]) < rateWindow {
+			a--
+		}
+		dt := times[b].Sub(times[a]).Seconds()
+		if dt <= 0 {
+			continue
+		}
+		if color == "climb" {
+			vals[i] = float64(pts[b].PressureAltitude-pts[a].PressureAltitude) / dt
+		} else {
+			dist := 0.0
+			for k := a; k < b; k++ {
+				dist += pts[k].Distance(pts[k+1])
+			}
+			vals[i] = dist / dt * 3600
+		}
+	}
+	return vals
+}
+
+//eventIndex is the first fix at or after ev, which only has a time of day
+func eventIndex(ev igc.Event, times []time.Time) int {
+	if len(times) == 0 {
+		return -1
+	}
+	y, m, d := times[0].Date()
+	at := time.Date(y, m, d, ev.Time.Hour(), ev.Time.Minute(), ev.Time.Second(), 0, time.UTC)
+	if at.Before(times[0]) && times[len(times)-1].Day() != times[0].Day() {
+		at = at.AddDate(0, 0, 1) //after midnight
+	}
+	for i := range times {
+		if !times[i].Before(at) {
+			return i
+		}
+	}
+	return -1
+}
+
+//buildKML makes a KML document of rec: the track as a 3D line, and placemarks
+//for takeoff, landing, events and the declared task
+func buildKML(rec trackRecord, opts exportOptions) kml {
+	t := rec.Track
+	pts, times := t.Points, pointTimes(t)
+
+	doc := kmlDocument{
+		Name:        trackTitle(t),
+		Description: trackDescription(t),
+	}
+
+	//the track, cut where the color changes
+	line := kmlFolder{Name: "Track"}
+	styles := []kmlStyle{plainStyle}
+	switch opts.color {
+	case "climb":
+		styles = climbStyles
+	case "speed":
+		styles = speedStyles
+	}
+	for _, s := range styles {
+		doc.Styles = append(doc.Styles, kmlStyleElem{s.id, s.color, 2})
+	}
+	var vals []float64
+	if opts.color != "" {
+		vals = colorValues(pts, times, opts.color)
+	}
+	for start := 0; start < len(pts)-1; {
+		style, end := styles[0], len(pts)-1
+		if vals != nil {
+			style, end = styleFor(styles, vals[start]), start+1
+			for end < len(pts)-1 && styleFor(styles, vals[end]).id == style.id {
+				end++
+			}
+		}
+		//segments share their end points, so the line has no gaps
+		line.Placemarks = append(line.Placemarks, kmlPlacemark{
+			StyleURL:   "#" + style.id,
+			LineString: &kmlLineString{1, "absolute", kmlCoordinates(pts[start:end+1], opts)},
+		})
+		start = end
+	}
+	doc.Folders = append(doc.Folders, line)
+
+	//takeoff, landing and events
+	marks := kmlFolder{Name: "Flight"}
+	if len(pts) > 0 {
+		f := rec.Flight
+		marks.Placemarks = append(marks.Placemarks,
+			kmlPlace("Takeoff", "", pts[f.Start], times[f.Start], opts),
+			kmlPlace("Landing", "", pts[f.End], times[f.End], opts))
+	}
+	for _, ev := range t.Events {
+		if i := eventIndex(ev, times); i >= 0 {
+			name := strings.TrimSpace(ev.Type)
+			marks.Placemarks = append(marks.Placemarks, kmlPlace(name, strings.TrimSpace(ev.Data), pts[i], times[i], opts))
+		}
+	}
+	doc.Folders = append(doc.Folders, marks)
+
+	//the declared task, on the ground
+	if wps := taskWaypoints(t.Task); wps != nil {
+		task := kmlFolder{Name: "Task"}
+		for _, wp := range wps {
+			task.Placemarks = append(task.Placemarks, kmlPlacemark{
+				Name:        wp.name,
+				Description: wp.kind,
+				Point:       &kmlPoint{"clampToGround", fmt.Sprintf("%.6f,%.6f,0", wp.Lng.Degrees(), wp.Lat.Degrees())},
+			})
+		}
+		doc.Folders = append(doc.Folders, task)
+	}
+
+	return kml{Document: doc}
+}
+
+//writeKML writes rec as a KML document for Google Earth
+func writeKML(w io.Writer, rec trackRecord, opts exportOptions) error {
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", " ")
+	err = enc.Encode(buildKML(rec, opts))
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+//writeKMZ writes rec as KML zipped up, which is what KMZ is
+func writeKMZ(w io.Writer, rec trackRecord, opts exportOptions) error {
+	zw := zip.NewWriter(w)
+	f, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     "doc.kml",
+		Method:   zip.Deflate,
+		Modified: rec.Registered,
+	})
+	if err != nil {
+		return err
+	}
+	err = writeKML(f, rec, opts)
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//limits on the page size of track listings
+const (
+	defaultListLimit = 50
+	maxListLimit     = 1000
+)
+
+//listParams are the query parameters that turn the track listing into a TrackPage
+var listParams = []string{"limit", "after", "sort", "order", "pilot", "glider", "glider_id", "class", "from", "to"}
+
+//TrackPage is one page of a filtered and sorted track listing
+type TrackPage struct {
+	IDs   []string `json:"ids"`
+	Total int      `json:"total"`          //tracks matching the filters, on all pages
+	Next  string   `json:"next,omitempty"` //give as after= to get the next page. Empty on the last page.
+}
+
+//listQuery is a parsed track listing request
+type listQuery struct {
+	limit    int
+	after    *listCursor
+	sortBy   string //registered, date or length
+	desc     bool
+	pilot    string
+	glider   string
+	gliderID string
+	class    string
+	from, to time.Time //flight date range, both inclusive. Zero when not given.
+}
+
+//listCursor is where the previous page ended: the sort key and ID of its last track
+type listCursor struct {
+	key float64
+	id  string
+}
+
+//listItem is a track with the value it is sorted by
+type listItem struct {
+	id  string
+	key float64
+}
+
+//isListQuery reports if q asks for paging, sorting or filtering
+func isListQuery(q url.Values) bool {
+	for _, p := range listParams {
+		if _, ok := q[p]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+//writes one page of the track listing
+func (s *server) listTracks(w http.ResponseWriter, r *http.Request) {
+	lq, err := parseListQuery(r.URL.Query())
+	if err != nil {
+		errorHandler(w, http.StatusBadRequest, fmt.Sprintf("Error: %s", err))
+		return
+	}
+	writeJSON(w, s.trackPage(lq))
+}
+
+//trackPage filters, sorts and pages our tracks as lq says
+func (s *server) trackPage(lq listQuery) TrackPage {
+	var items []listItem
+	for _, id := range s.store.List() {
+		rec, err := s.store.Get(id)
+		if err != nil {
+			continue //deleted while we were looking
+		}
+		if !lq.matches(rec) {
+			continue
+		}
+		items = append(items, listItem{id, lq.sortKey(rec)})
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return lq.less(items[i], items[j])
+	})
+
+	page := TrackPage{IDs: []string{}, Total: len(items)}
+
+	//skip to after the cursor
+	start := 0
+	if lq.after != nil {
+		c := listItem{lq.after.id, lq.after.key}
+		start = sort.Search(len(items), func(i int) bool {
+			return lq.less(c, items[i])
+		})
+	}
+
+	end := start + lq.limit
+	if end > len(items) {
+		end = len(items)
+	}
+	for _, it := range items[start:end] {
+		page.IDs = append(page.IDs, it.id)
+	}
+	if end < len(items) {
+		last := items[end-1]
+		page.Next = encodeCursor(listCursor{last.key, last.id})
+	}
+	return page
+}
+
+//matches reports if rec passes every filter in lq
+func (lq listQuery) matches(rec trackRecord) bool {
+	t := rec.Track
+	if lq.pilot != "" && !strings.EqualFold(t.Pilot, lq.pilot) {
+		return false
+	}
+	if lq.glider != "" && !strings.EqualFold(t.GliderType, lq.glider) {
+		return false
+	}
+	if lq.gliderID != "" && !strings.EqualFold(t.GliderID, lq.gliderID) {
+		return false
+	}
+	if lq.class != "" && !strings.EqualFold(t.CompetitionClass, lq.class) {
+		return false
+	}
+	if !lq.from.IsZero() && t.Date.Before(lq.from) {
+		return false
+	}
+	if !lq.to.IsZero() && t.Date.After(lq.to) {
+		return false
+	}
+	return true
+}
+
+//sortKey is the value rec is sorted by
+func (lq listQuery) sortKey(rec trackRecord) float64 {
+	switch lq.sortBy {
+	case "date":
+		return float64(rec.Track.Date.Unix())
+	case "length":
+		return rec.Stats.TrackLength
+	default:
+		return float64(rec.Registered.UnixNano()) / 1e9
+	}
+}
+
+//less orders items by key, then by ID so the order is always the same
+func (lq listQuery) less(a, b listItem) bool {
+	if a.key != b.key {
+		return (a.key < b.key) != lq.desc
+	}
+	return a.id < b.id
+}
+
+//parseListQuery reads the listing parameters in q
+func parseListQuery(q url.Values) (listQuery, error) {
+	lq := listQuery{
+		limit:    defaultListLimit,
+		sortBy:   "registered",
+		pilot:    q.Get("pilot"),
+		glider:   q.Get("glider"),
+		gliderID: q.Get("glider_id"),
+		class:    q.Get("class"),
+	}
+
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			return lq, fmt.Errorf("limit must be a number from 1 to %d", maxListLimit)
+		}
+		lq.limit = n
+	}
+
+	switch v := q.Get("sort"); v {
+	case "":
+	case "registered", "date", "length":
+		lq.sortBy = v
+	default:
+		return lq, fmt.Errorf("sort must be registered, date or length")
+	}
+
+	switch q.Get("order") {
+	case "", "asc":
+	case "desc":
+		lq.desc = true
+	default:
+		return lq, fmt.Errorf("order must be asc or desc")
+	}
+
+	var err error
+	if v := q.Get("from"); v != "" {
+		lq.from, err = time.Parse("2006-01-02", v)
+		if err != nil {
+			return lq, fmt.Errorf("from must be a date like 2018-07-02")
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		lq.to, err = time.Parse("2006-01-02", v)
+		if err != nil {
+			return lq, fmt.Errorf("to must be a date like 2018-07-02")
+		}
+	}
+
+	if v := q.Get("after"); v != "" {
+		c, err := decodeCursor(v)
+		if err != nil {
+			return lq, fmt.Errorf("after is not a cursor we gave out")
+		}
+		lq.after = &c
+	}
+	return lq, nil
+}
+
+//encodeCursor turns c into an opaque string for clients
+func encodeCursor(c listCursor) string {
+	s := strconv.FormatFloat(c.key, 'g', -1, 64) + "," + c.id
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+//decodeCursor reads a cursor made by encodeCursor
+func decodeCursor(s string) (listCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return listCursor{}, err
+	}
+	parts := strings.SplitN(string(b), ",", 2)
+	if len(parts) != 2 {
+		return listCursor{}, fmt.Errorf("bad cursor")
+	}
+	key, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return listCursor{}, err
+	}
+	return listCursor{key, parts[1]}, nil
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"mime"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -14,8 +17,25 @@ import (
 
 var startTime time.Time
 
-// var registeredTrackIDs []string //a little bit of duplicate data.
-var registeredTracks []igc.Track
+//server holds what our handlers need, so they can be given other backends
+type server struct {
+	store     TrackStore
+	index     *searchIndex   //finds tracks in store
+	fetcher   *fetcher       //gets IGC files from urls clients give us
+	jobs      *jobQueue      //registrations and optimizations running in the background
+	optimized *optimizeCache //free distance tasks we have worked out
+	maxUpload int64          //largest POST body we accept, in bytes
+	maxImport int64          //largest zip archive we accept, in bytes
+
+	batchMax     int //most tracks in one batch
+	batchWorkers int //how many tracks in a batch are fetched at once
+
+	deleteGrace time.Duration //how long deleted tracks can be restored
+	adminToken  string        //needed for admin endpoints. Empty turns them off.
+
+	rules ScoringRules //what closed courses are worth
+	zones TaskZones    //observation zones declared tasks are checked with
+}
 
 //Service contains data about our service
 type Service struct {
@@ -41,6 +61,20 @@ type IDdata struct {
 	Glider      string    `json:"glider"`       //<glider>,
 	GliderID    string    `json:"glider_id"`    //<glider_id>,
 	TrackLength float64   `json:"track_length"` //<calculated total track length>
+	LoggerID    string    `json:"logger_id"`    //<serial of the flight recorder, from the A-record>
+}
+
+//newIDdata fills in IDdata from a registered track
+func newIDdata(rec trackRecord) IDdata {
+	t := rec.Track
+	return IDdata{
+		t.Date,                //Date from File Header, H-record
+		t.Pilot,               //Pilot name
+		t.GliderType,          //Glider type
+		t.GliderID,            //Glider ID
+		rec.Stats.TrackLength, //Calculated track length, in flight
+		t.UniqueID,            //Flight recorder serial
+	}
 }
 
 //errorHandler is a simple self made function to deal with bad requests
@@ -51,13 +85,40 @@ func errorHandler(w http.ResponseWriter, code int, mes string) {
 	log.Print(mes)
 }
 
-//trackDistance calculates rough distance
-func trackDistance(t igc.Track) float64 {
-	totalDistance := 0.0
-	for j := 0; j < len(t.Points)-1; j++ {
-		totalDistance += t.Points[j].Distance(t.Points[j+1])
+//writeJSON marshals v and writes it as our answer
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		str := fmt.Sprintf("Marshal error: %s", err)
+		errorHandler(w, http.StatusInternalServerError, str)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+//limitBody refuses a body larger than max bytes before anything is read, and
+//makes sure we never read more than max of it. Returns false if it answered already.
+func limitBody(w http.ResponseWriter, r *http.Request, max int64) bool {
+	if r.ContentLength > max {
+		str := fmt.Sprintf("Error: body is larger than %d bytes", max)
+		errorHandler(w, http.StatusRequestEntityTooLarge, str)
+		return false
 	}
-	return totalDistance
+	r.Body = http.MaxBytesReader(w, r.Body, max)
+	return true
+}
+
+//bodyError answers a body we could not read, with what as the start of the message.
+//Bodies cut off by limitBody get 413, like the ones we refused up front.
+func bodyError(w http.ResponseWriter, what string, err error) {
+	str := fmt.Sprintf("%s: %s", what, err)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		errorHandler(w, http.StatusRequestEntityTooLarge, str)
+		return
+	}
+	errorHandler(w, http.StatusBadRequest, str)
 }
 
 //copied code from stackoverflow. Could be improved on.
@@ -143,19 +204,17 @@ func handlAPI(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func handlAPIigc(w http.ResponseWriter, r *http.Request) {
+func (s *server) handlAPIigc(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		//check if we have any data yet.
-		if len(registeredTracks) == 0 {
-			errorHandler(w, http.StatusNoContent, "No tracks registered yet.")
+		//paging, sorting or filtering gives a TrackPage instead
+		if isListQuery(r.URL.Query()) {
+			s.listTracks(w, r)
 			return
 		}
-		//store all IDs in a list
-		var ids []string
-		for i := 0; i < len(registeredTracks); i++ {
-			ids = append(ids, registeredTracks[i].UniqueID)
-		}
+
+		//get all IDs in a list. Empty if we don't have any data yet.
+		ids := s.store.List()
 		//turn list into json
 		js, err := json.Marshal(ids)
 		if err != nil {
@@ -167,52 +226,56 @@ func handlAPIigc(w http.ResponseWriter, r *http.Request) {
 			w.Write(js)
 		}
 	case "POST":
-		//make decoder for our POST body
-		decoder := json.NewDecoder(r.Body)
-		var url PostURL
+		//refuse bodies that are too big before reading anything
+		if !limitBody(w, r, s.maxUpload) {
+			return
+		}
 
-		//decode the json we've recieved
-		err1 := decoder.Decode(&url)
-		if err1 != nil {
-			str := fmt.Sprintf("Decode error: %s", err1)
-			errorHandler(w, http.StatusInternalServerError, str)
-			return //something went wrong
+		//IGC content is either uploaded directly, or found at a posted url.
+		//work is what registers it, now or in the background.
+		var work jobWork
+		mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if isUpload(mediatype) {
+			raw, err1 := readUpload(r, mediatype)
+			if err1 != nil {
+				bodyError(w, "Upload error", err1)
+				return //something went wrong
+			}
+			work = func(<-chan struct{}) (string, error) {
+				return s.register(raw)
+			}
+		} else {
+			//make decoder for our POST body
+			decoder := json.NewDecoder(r.Body)
+			var url PostURL
+
+			//decode the json we've recieved
+			err1 := decoder.Decode(&url)
+			if err1 != nil {
+				bodyError(w, "Decode error", err1)
+				return //something went wrong
+			}
+			work = func(<-chan struct{}) (string, error) {
+				return s.registerURL(url.URL)
+			}
 		}
 
-		//get track information from provided url.
-		track, err2 := igc.ParseLocation(url.URL)
-		if err2 != nil {
-			str := fmt.Sprintf("Problem reading the track: %s", err2)
-			errorHandler(w, http.StatusInternalServerError, str)
-			return //something went wrong
+		//with ?async=true we answer right away, and the client polls the job
+		if r.URL.Query().Get("async") == "true" {
+			s.submitJob(w, work)
+			return
 		}
 
-		//put the ID of the track we found in a struct to be returned later.
-		id := POSTid{track.UniqueID}
-		//and turn it into a json
-		js, err3 := json.Marshal(id)
+		//get and parse the track and add it to our store, unless we already have it registered
+		id, err3 := work(nil)
 		if err3 != nil {
-			str := fmt.Sprintf("Marshal error: %s", err3)
-			errorHandler(w, http.StatusInternalServerError, str)
+			code, str := ingestError(err3)
+			errorHandler(w, code, str)
 			return //something went wrong
 		}
 
-		//check if we already have the track registered
-		for i := 0; i < len(registeredTracks); i++ {
-			if registeredTracks[i].UniqueID == track.UniqueID {
-				str := fmt.Sprintf("Error: Already registered")
-				errorHandler(w, http.StatusBadRequest, str)
-				return //duplicate found
-			}
-		}
-
-		//adds track track to global slice
-		//registeredTrackIDs = append(registeredTrackIDs, track.UniqueID)
-		registeredTracks = append(registeredTracks, track)
-
-		//we did everything correctly, hopefully
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(js)
+		//we did everything correctly, hopefully. Give the ID of the track as json
+		writeJSON(w, POSTid{id})
 
 	default:
 		//unexpected request
@@ -222,77 +285,144 @@ func handlAPIigc(w http.ResponseWriter, r *http.Request) {
 }
 
 //writes information about a track on a given ID
-func handlAPIigcID(w http.ResponseWriter, r *http.Request) {
+func (s *server) handlAPIigcID(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "DELETE" {
+		s.deleteTrack(w, r)
+		return
+	}
+
 	//container for the http adress vaiable {ID}
 	vars := mux.Vars(r)
 
-	//goes throug and looks for matching ID
-	for i := 0; i < len(registeredTracks); i++ {
-		if registeredTracks[i].UniqueID == vars["ID"] {
+	//looks for matching ID
+	rec, err := s.store.Get(vars["ID"])
+	if err != nil {
+		//in case we didn't find the track
+		str := fmt.Sprintf("Error: %s", err)
+		errorHandler(w, http.StatusBadRequest, str)
+		return
+	}
 
-			//calculates rough distance
-			totalDistance := trackDistance(registeredTracks[i])
+	//?view=full gives every field we have, not just the basic ones
+	view := r.URL.Query().Get("view")
+	if view != "" && view != "basic" && view != "full" {
+		errorHandler(w, http.StatusBadRequest, "Error: view must be basic or full")
+		return
+	}
 
-			//struct to be marshaled and sendt as json
-			data := IDdata{
-				registeredTracks[i].Date,       //Date from File Header, H-record
-				registeredTracks[i].Pilot,      //Pilot name
-				registeredTracks[i].GliderType, //Glider type
-				registeredTracks[i].GliderID,   //Glider ID
-				totalDistance,                  //Calculated total track length
-			}
+	//the answer depends on Accept, so caches must keep them apart
+	w.Header().Add("Vary", "Accept")
 
-			//make the json struct
-			js, err := json.Marshal(data)
-			if err != nil {
-				str := fmt.Sprintf("Marshal error: %s", err)
-				errorHandler(w, http.StatusInternalServerError, str)
-			} else {
-				//We successfully found data and made the json.
-				w.Header().Set("Content-Type", "application/json")
-				w.Write(js)
-			}
-			return //end function after finding track
+	//with Accept: application/geo+json we give a GeoJSON Feature with the points too
+	if acceptsGeoJSON(r) {
+		opts, err1 := parseExportOptions(r.URL.Query())
+		if err1 != nil {
+			errorHandler(w, http.StatusBadRequest, fmt.Sprintf("Error: %s", err1))
+			return
+		}
+		f, err1 := newGeoFeature(rec.view(includeGround(r)), view == "full", opts)
+		if err1 != nil {
+			str := fmt.Sprintf("Marshal error: %s", err1)
+			errorHandler(w, http.StatusInternalServerError, str)
+			return
 		}
+		writeGeoJSON(w, f)
+		return
 	}
 
-	//in case we didn't find the track
-	str := fmt.Sprintf("Error: Did not find track")
-	errorHandler(w, http.StatusBadRequest, str)
-
+	//make the json struct
+	js, err := marshalFields(rec.view(includeGround(r)), view == "full")
+	if err != nil {
+		str := fmt.Sprintf("Marshal error: %s", err)
+		errorHandler(w, http.StatusInternalServerError, str)
+	} else {
+		//We successfully found data and made the json.
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	}
 }
 
 //writes content of a specified ID and field
-func handlAPIigcIDfield(w http.ResponseWriter, r *http.Request) {
+func (s *server) handlAPIigcIDfield(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 
 	//container for the http adress vaiables {ID} and {field}
 	vars := mux.Vars(r)
 
 	//Look for matching track ID
-	for i := 0; i < len(registeredTracks); i++ {
-		if registeredTracks[i].UniqueID == vars["ID"] {
-			//Look for matching data name. If found; print data
-			switch vars["field"] {
-			case "pilot":
-				fmt.Fprint(w, registeredTracks[i].Pilot)
-			case "glider":
-				fmt.Fprint(w, registeredTracks[i].GliderType)
-			case "glider_id":
-				fmt.Fprint(w, registeredTracks[i].GliderID)
-			case "track_length":
-				fmt.Fprint(w, trackDistance(registeredTracks[i]))
-			case "H_date":
-				fmt.Fprint(w, registeredTracks[i].Date)
-			default:
-				//last field does not match or not implemented yet.
-				w.WriteHeader(http.StatusNotFound)
-			}
-			return
-		}
+	rec, err := s.store.Get(vars["ID"])
+	if err != nil {
+		//we did not find any matches
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	//Look for matching data name. If found; print data
+	field, ok := findField(vars["field"])
+	if !ok {
+		//field does not match or not implemented yet.
+		unknownField(w, vars["field"])
+		return
+	}
+	fmt.Fprint(w, field.value(rec.view(includeGround(r))))
+}
+
+//queues work as a job and tells the client where to follow it
+func (s *server) submitJob(w http.ResponseWriter, work jobWork) {
+	job, err := s.jobs.submit(work)
+	if err == errQueueFull {
+		errorHandler(w, http.StatusServiceUnavailable, fmt.Sprintf("Error: %s", err))
+		return
+	} else if err != nil {
+		errorHandler(w, http.StatusInternalServerError, fmt.Sprintf("Job error: %s", err))
+		return
+	}
+	writeAccepted(w, job)
+}
+
+//writes job with 202 Accepted, and tells the client where to follow it
+func writeAccepted(w http.ResponseWriter, job Job) {
+	js, err := json.Marshal(job)
+	if err != nil {
+		str := fmt.Sprintf("Marshal error: %s", err)
+		errorHandler(w, http.StatusInternalServerError, str)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/igcinfo/api/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(js)
+}
+
+//writes the status of a background job. DELETE cancels it first.
+func (s *server) handlAPIjobsID(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var job Job
+	var err error
+	switch r.Method {
+	case "GET":
+		job, err = s.jobs.get(vars["jobID"])
+	case "DELETE":
+		job, err = s.jobs.cancel(vars["jobID"])
+	default:
+		str := fmt.Sprintf("Sorry, only GET and DELETE methods are supported.")
+		errorHandler(w, http.StatusBadRequest, str)
+		return
+	}
+	if err != nil {
+		errorHandler(w, http.StatusNotFound, fmt.Sprintf("Error: %s", err))
+		return
+	}
+
+	js, err := json.Marshal(job)
+	if err != nil {
+		str := fmt.Sprintf("Marshal error: %s", err)
+		errorHandler(w, http.StatusInternalServerError, str)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
 	}
-	//we did not find any matches
-	w.WriteHeader(http.StatusNotFound)
 }
 
 //mariusz is a slightly modified version of the code found in the readme of github.com/marni/goigc
@@ -308,6 +438,64 @@ func mariusz(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+//envInt64 reads a non-negative number from the environment, or gives def if it's not set
+func envInt64(name string, def int64) int64 {
+	return envAtLeast(name, def, 0)
+}
+
+//envAtLeast reads a number of at least min from the environment, or gives def if it's not set
+func envAtLeast(name string, def, min int64) int64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < min {
+		log.Fatalf("Bad %s %q, must be at least %d", name, v, min)
+	}
+	return n
+}
+
+//envDuration reads a duration like "10s" from the environment, or gives def if it's not set
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Fatalf("Bad %s %q", name, v)
+	}
+	return d
+}
+
+//newRouter sets up all our paths using gorilla mux
+func newRouter(s *server) *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/", handl404)
+	r.HandleFunc("/igcinfo/api", handlAPI)
+	r.HandleFunc("/igcinfo/api/igc", s.handlAPIigc)
+	r.HandleFunc("/igcinfo/api/batch", s.handlAPIbatch)
+	r.HandleFunc("/igcinfo/api/search", s.handlAPIsearch)
+	r.HandleFunc("/igcinfo/api/import", s.handlAPIimport)
+	r.HandleFunc("/igcinfo/api/geojson", s.handlAPIgeojson)
+	r.HandleFunc("/igcinfo/api/igc/{ID}", s.handlAPIigcID)
+	r.HandleFunc("/igcinfo/api/igc/{ID}/stats", s.handlAPIigcIDstats)
+	r.HandleFunc("/igcinfo/api/igc/{ID}/phases", s.handlAPIigcIDphases)
+	r.HandleFunc("/igcinfo/api/igc/{ID}/wind", s.handlAPIigcIDwind)
+	r.HandleFunc("/igcinfo/api/igc/{ID}/optimized", s.handlAPIigcIDoptimized)
+	r.HandleFunc("/igcinfo/api/igc/{ID}/courses", s.handlAPIigcIDcourses)
+	r.HandleFunc("/igcinfo/api/igc/{ID}/task", s.handlAPIigcIDtask)
+	r.HandleFunc("/igcinfo/api/igc/{ID}/export", s.handlAPIigcIDexport)
+	r.HandleFunc("/igcinfo/api/igc/{ID}/points", s.handlAPIigcIDpoints)
+	r.HandleFunc("/igcinfo/api/igc/{ID}/simplify", s.handlAPIigcIDsimplify)
+	r.HandleFunc("/igcinfo/api/igc/{ID}/{field}", s.handlAPIigcIDfield)
+	r.HandleFunc("/igcinfo/api/jobs/{jobID}", s.handlAPIjobsID)
+	r.HandleFunc("/igcinfo/api/admin/deleted", s.handlAPIadminDeleted)
+	r.HandleFunc("/igcinfo/api/admin/igc/{ID}/restore", s.handlAPIadminRestore)
+	return r
+}
+
 func init() {
 	//make a timestamp for uptime.
 	startTime = time.Now()
@@ -317,15 +505,75 @@ func main() {
 	//find our port
 	port := os.Getenv("PORT")
 
-	//all our paths using gorilla mux
-	r := mux.NewRouter()
-	r.HandleFunc("/", handl404)
-	r.HandleFunc("/igcinfo/api", handlAPI)
-	r.HandleFunc("/igcinfo/api/igc", handlAPIigc)
-	r.HandleFunc("/igcinfo/api/igc/{ID}", handlAPIigcID)
-	r.HandleFunc("/igcinfo/api/igc/{ID}/{field}", handlAPIigcIDfield)
+	//where we keep our tracks. STORAGE=file keeps them in DATA_DIR between restarts
+	var store TrackStore
+	switch os.Getenv("STORAGE") {
+	case "", "memory":
+		store = newMemoryStore()
+	case "file":
+		dir := os.Getenv("DATA_DIR")
+		if dir == "" {
+			dir = "data"
+		}
+		fs, err := newFileStore(dir)
+		if err != nil {
+			log.Fatalf("Could not open storage in %s: %s", dir, err)
+		}
+		store = fs
+	default:
+		log.Fatalf("Unknown STORAGE %q, use memory or file", os.Getenv("STORAGE"))
+	}
+	//keep a search index of everything in the store
+	index := newSearchIndex()
+	store = newIndexedStore(store, index)
+
+	//how big uploads can be
+	maxUpload := envInt64("MAX_UPLOAD_SIZE", defaultMaxUpload)
+
+	//how we get tracks from urls
+	fetch := newFetcher(
+		envDuration("FETCH_TIMEOUT", 10*time.Second),
+		envInt64("FETCH_MAX_SIZE", defaultMaxUpload),
+		int(envInt64("FETCH_MAX_REDIRECTS", 5)),
+		os.Getenv("FETCH_ALLOW_PRIVATE") == "true")
+
+	//background registrations. Without workers or room in the queue no job would ever run.
+	jobs := newJobQueue(
+		int(envAtLeast("JOB_WORKERS", 4, 1)),
+		int(envAtLeast("JOB_QUEUE_SIZE", 100, 1)))
+
+	//how closed courses are scored
+	rules, err := parseScoringRules(os.Getenv("SCORING_RULES"))
+	if err != nil {
+		log.Fatalf("Bad SCORING_RULES: %s", err)
+	}
+	//the zones declared tasks are checked with
+	zones, err := parseTaskZones(os.Getenv("TASK_ZONES"))
+	if err != nil {
+		log.Fatalf("Bad TASK_ZONES: %s", err)
+	}
+
+	s := &server{
+		store:        store,
+		index:        index,
+		fetcher:      fetch,
+		jobs:         jobs,
+		optimized:    newOptimizeCache(),
+		maxUpload:    maxUpload,
+		maxImport:    envInt64("IMPORT_MAX_SIZE", defaultMaxImport),
+		batchMax:     int(envAtLeast("BATCH_MAX", 100, 1)),
+		batchWorkers: int(envAtLeast("BATCH_WORKERS", 4, 1)), //none would leave every batch waiting
+		deleteGrace:  envDuration("DELETE_GRACE", 7*24*time.Hour),
+		adminToken:   os.Getenv("ADMIN_TOKEN"),
+		rules:        rules,
+		zones:        zones,
+	}
+
+	//remove deleted tracks for good once they can't be restored anymore
+	s.purgeDeleted(time.Now())
+	go s.purgeLoop(time.Minute)
 
 	//serve our functionallity
-	http.Handle("/", r)
+	http.Handle("/", newRouter(s))
 	http.ListenAndServe(":"+port, nil)
 }
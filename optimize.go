@@ -0,0 +1,357 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	igc "github.com/marni/goigc"
+)
+
+//settings for free distance optimization
+const (
+	optimizeTurnpoints = 5   //the most turnpoints free distance allows
+	optimizeMaxPoints  = 500 //the track is thinned to this many points before the search
+)
+
+//OptimizedTask is the best free distance task found in a track
+type OptimizedTask struct {
+	Distance   float64     `json:"distance"`   //km, start through the turnpoints to finish
+	Turnpoints int         `json:"turnpoints"` //how many of the 5 allowed were worth using
+	Points     []TaskPoint `json:"points"`     //start, turnpoints and finish
+	Task       igc.Task    `json:"task"`       //the same, as goigc has it. Lat and Lng in radians.
+}
+
+//TaskPoint is a point of a task, in degrees
+type TaskPoint struct {
+	Lat  float64   `json:"lat"`
+	Lng  float64   `json:"lng"`
+	Time time.Time `json:"time"`
+}
+
+//dpOptimizer is an igc.Optimizer using dynamic programming.
+//
+//The track is first thinned to maxPoints points. The longest path through
+//them is found in O(n² * turnpoints), and each of its points is then moved
+//to the best fix nearby in the full track.
+type dpOptimizer struct {
+	maxPoints int
+	times     []time.Time     //full times of the points Optimize gets. Worked out from the track when nil.
+	cancel    <-chan struct{} //when closed, Optimize gives up with errJobCancelled
+}
+
+//newDPOptimizer makes a dpOptimizer. times and cancel may be nil. Give times
+//when the track is cut out of a longer one, since pointTimes can't see a
+//midnight that passed before the first point.
+func newDPOptimizer(maxPoints int, times []time.Time, cancel <-chan struct{}) igc.Optimizer {
+	return &dpOptimizer{maxPoints, times, cancel}
+}
+
+//Optimize finds the longest path through up to nPoints turnpoints for every
+//number of turnpoints, and gives the one score likes best. The search only
+//knows distance, so score is used to choose, not to search.
+func (o *dpOptimizer) Optimize(track igc.Track, nPoints int, score igc.Score) (igc.Task, error) {
+	pts := track.Points
+	if len(pts) < 2 {
+		return igc.Task{}, errors.New("Track has too few points to optimize")
+	}
+	if nPoints < 0 {
+		return igc.Task{}, errors.New("Number of turnpoints can not be negative")
+	}
+	times := o.times
+	if len(times) != len(pts) {
+		times = pointTimes(track)
+	}
+
+	idx := thinIndexes(len(pts), o.maxPoints)
+	n := len(idx)
+	step := (len(pts)-1)/(n-1) + 1
+
+	dist := make([][]float64, n)
+	for i := range dist {
+		dist[i] = make([]float64, n)
+		for j := 0; j < i; j++ {
+			dist[i][j] = pts[idx[j]].Distance(pts[idx[i]])
+		}
+	}
+
+	//best[k][j] is the longest path of k legs ending at thinned point j, from[k][j] the point before it.
+	//-1 when there's no such path.
+	legs := nPoints + 1
+	best := make([][]float64, legs+1)
+	from := make([][]int, legs+1)
+	best[0] = make([]float64, n)
+	for k := 1; k <= legs; k++ {
+		best[k] = make([]float64, n)
+		from[k] = make([]int, n)
+		for j := 0; j < n; j++ {
+			if o.cancelled() {
+				return igc.Task{}, errJobCancelled
+			}
+			best[k][j], from[k][j] = -1, -1
+			for i := 0; i < j; i++ {
+				if best[k-1][i] < 0 {
+					continue
+				}
+				if d := best[k-1][i] + dist[j][i]; d > best[k][j] {
+					best[k][j], from[k][j] = d, i
+				}
+			}
+		}
+	}
+
+	//the best path for each number of legs, as the score sees it
+	var task igc.Task
+	found := false
+	bestScore := 0.0
+	for k := 1; k <= legs; k++ {
+		end := -1
+		for j := 0; j < n; j++ {
+			if best[k][j] >= 0 && (end < 0 || best[k][j] > best[k][end]) {
+				end = j
+			}
+		}
+		if end < 0 {
+			break //not enough points for this many legs
+		}
+		path := make([]int, k+1)
+		path[k] = end
+		for l := k; l > 0; l-- {
+			path[l-1] = from[l][path[l]]
+		}
+		for i := range path {
+			path[i] = idx[path[i]]
+		}
+		refinePath(pts, path, step)
+
+		t := newTask(track, times, path)
+		if sc := score(t); !found || sc > bestScore {
+			task, bestScore, found = t, sc, true
+		}
+	}
+	return task, nil
+}
+
+//thinIndexes picks up to max indexes spread evenly over n points,
+//always keeping the first and last one. n and max must be 2 or more.
+func thinIndexes(n, max int) []int {
+	if n < max {
+		max = n
+	}
+	idx := make([]int, max)
+	for i := range idx {
+		idx[i] = i * (n - 1) / (max - 1)
+	}
+	return idx
+}
+
+func (o *dpOptimizer) cancelled() bool {
+	select {
+	case <-o.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+//refinePath moves each point of path, indexes into pts, up to step fixes
+//either way if that makes the path longer. The order of points is kept.
+func refinePath(pts []igc.Point, path []int, step int) {
+	for round := 0; round < 5; round++ {
+		moved := false
+		for p := range path {
+			lo, hi := path[p]-step, path[p]+step
+			if p > 0 && lo < path[p-1] {
+				lo = path[p-1]
+			}
+			if p < len(path)-1 && hi > path[p+1] {
+				hi = path[p+1]
+			}
+			if lo < 0 {
+				lo = 0
+			}
+			if hi > len(pts)-1 {
+				hi = len(pts) - 1
+			}
+
+			legsAt := func(i int) float64 {
+				d := 0.0
+				if p > 0 {
+					d += pts[path[p-1]].Distance(pts[i])
+				}
+				if p < len(path)-1 {
+					d += pts[i].Distance(pts[path[p+1]])
+				}
+				return d
+			}
+			bestAt, bestLen := path[p], legsAt(path[p])
+			for i := lo; i <= hi; i++ {
+				if l := legsAt(i); l > bestLen {
+					bestAt, bestLen = i, l
+				}
+			}
+			if bestAt != path[p] {
+				path[p] = bestAt
+				moved = true
+			}
+		}
+		if !moved {
+			return
+		}
+	}
+}
+
+//newTask makes a task going through the points of track at path
+func newTask(track igc.Track, times []time.Time, path []int) igc.Task {
+	point := func(i int) igc.Point {
+		p := track.Points[i]
+		p.Time = times[i]
+		return p
+	}
+	task := igc.Task{
+		Date:       track.Date,
+		Start:      point(path[0]),
+		Finish:     point(path[len(path)-1]),
+		Turnpoints: []igc.Point{},
+	}
+	for _, i := range path[1 : len(path)-1] {
+		task.Turnpoints = append(task.Turnpoints, point(i))
+	}
+	return task
+}
+
+//newOptimizedTask describes task for clients
+func newOptimizedTask(task igc.Task) OptimizedTask {
+	ot := OptimizedTask{
+		Distance:   task.Distance(),
+		Turnpoints: len(task.Turnpoints),
+		Task:       task,
+	}
+	all := append([]igc.Point{task.Start}, task.Turnpoints...)
+	all = append(all, task.Finish)
+	for _, p := range all {
+		ot.Points = append(ot.Points, TaskPoint{p.Lat.Degrees(), p.Lng.Degrees(), p.Time})
+	}
+	return ot
+}
+
+//optimizeCache keeps optimized tasks, and which tracks are being optimized
+type optimizeCache struct {
+	mu       sync.Mutex
+	results  map[string]OptimizedTask //by track ID
+	failures map[string]string        //track ID -> why optimizing it failed, so we don't try again
+	jobs     map[string]string        //track ID -> ID of the last job optimizing it
+}
+
+func newOptimizeCache() *optimizeCache {
+	return &optimizeCache{
+		results:  make(map[string]OptimizedTask),
+		failures: make(map[string]string),
+		jobs:     make(map[string]string),
+	}
+}
+
+//result gives the optimized task of track id, or why working it out failed
+func (c *optimizeCache) result(id string) (OptimizedTask, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if reason, ok := c.failures[id]; ok {
+		return OptimizedTask{}, reason, true
+	}
+	ot, ok := c.results[id]
+	return ot, "", ok
+}
+
+//forget drops everything about track id, for when it is deleted
+func (c *optimizeCache) forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.results, id)
+	delete(c.failures, id)
+	delete(c.jobs, id)
+}
+
+//keepOptimized saves what optimizing track id gave, unless the track was
+//deleted while we worked on it
+func (s *server) keepOptimized(id string, ot OptimizedTask, err error) {
+	c := s.optimized
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, gone := s.store.Get(id); gone != nil {
+		return
+	}
+	if err != nil {
+		c.failures[id] = err.Error()
+	} else {
+		c.results[id] = ot
+	}
+}
+
+//optimizeJob gives the job optimizing rec, starting one if none is queued or running
+func (s *server) optimizeJob(rec trackRecord) (Job, error) {
+	c := s.optimized
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if jobID, ok := c.jobs[rec.ID]; ok {
+		job, err := s.jobs.get(jobID)
+		if err == nil && (job.Status == jobQueued || job.Status == jobRunning) {
+			return job, nil
+		}
+	}
+
+	job, err := s.jobs.submit(func(cancel <-chan struct{}) (string, error) {
+		track := rec.Track
+		pts, times := rec.flightPoints(false)
+		track.Points = pts
+		task, err := newDPOptimizer(optimizeMaxPoints, times, cancel).Optimize(track, optimizeTurnpoints, igc.Distance)
+		if err == errJobCancelled {
+			return "", err //asking again starts over
+		} else if err != nil {
+			s.keepOptimized(rec.ID, OptimizedTask{}, err)
+			return "", err
+		}
+		s.keepOptimized(rec.ID, newOptimizedTask(task), nil)
+		return rec.ID, nil
+	})
+	if err != nil {
+		return Job{}, err
+	}
+	c.jobs[rec.ID] = job.ID
+	return job, nil
+}
+
+//writes the best free distance task of a track. The first time, this
+//starts a job working it out and writes the job instead, with 202 Accepted.
+//If the job failed, later requests get its error with 422.
+func (s *server) handlAPIigcIDoptimized(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	rec, err := s.store.Get(vars["ID"])
+	if err != nil {
+		errorHandler(w, http.StatusNotFound, fmt.Sprintf("Error: %s", err))
+		return
+	}
+	if ot, reason, ok := s.optimized.result(rec.ID); ok {
+		if reason != "" {
+			//trying again would fail the same way
+			errorHandler(w, http.StatusUnprocessableEntity, fmt.Sprintf("Optimize error: %s", reason))
+			return
+		}
+		writeJSON(w, ot)
+		return
+	}
+
+	job, err := s.optimizeJob(rec)
+	if err == errQueueFull {
+		errorHandler(w, http.StatusServiceUnavailable, fmt.Sprintf("Error: %s", err))
+		return
+	} else if err != nil {
+		errorHandler(w, http.StatusInternalServerError, fmt.Sprintf("Job error: %s", err))
+		return
+	}
+	writeAccepted(w, job)
+}
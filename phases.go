@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	igc "github.com/marni/goigc"
+)
+
+//thresholds for telling circling from gliding
+const (
+	circlingRate   = 8.0              //degrees per second of turning, averaged over turnWindow
+	turnWindow     = 15 * time.Second //how far ahead we look when working out the turn rate
+	minPhase       = 30 * time.Second //shorter phases are merged into the ones around them
+	minHeadingMove = 0.001            //km a point must be from the next to give a heading
+)
+
+//Thermal is a phase of circling flight
+type Thermal struct {
+	Entry          time.Time `json:"entry"`
+	Exit           time.Time `json:"exit"`
+	Duration       string    `json:"duration"`
+	Direction      string    `json:"direction"`       //left or right
+	AltitudeGain   int64     `json:"altitude_gain"`   //metres, exit minus entry, can be negative
+	AvgClimb       float64   `json:"avg_climb"`       //m/s
+	DriftDistance  float64   `json:"drift_distance"`  //km from entry to exit
+	DriftDirection float64   `json:"drift_direction"` //degrees, where the thermal took us
+	DriftSpeed     float64   `json:"drift_speed"`     //km/h
+}
+
+//Glide is a phase of straight flight
+type Glide struct {
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	Duration     string    `json:"duration"`
+	Distance     float64   `json:"distance"`      //km, straight line from start to end
+	AltitudeLoss int64     `json:"altitude_loss"` //metres, can be negative
+	LD           *float64  `json:"ld,omitempty"`  //glide ratio, missing when no altitude was lost
+	Speed        float64   `json:"speed"`         //km/h
+}
+
+//FlightPhases is a flight split into thermals and glides
+type FlightPhases struct {
+	Thermals        []Thermal `json:"thermals"`
+	Glides          []Glide   `json:"glides"`
+	CirclingPercent float64   `json:"circling_percent"` //share of flight time spent circling
+}
+
+//phase is a run of points from start to end, both included
+type phase struct {
+	start, end int
+	circling   bool
+}
+
+//findPhases splits pts into circling and straight phases by how fast the heading changes
+func findPhases(pts []igc.Point, times []time.Time) []phase {
+	if len(pts) < 2 {
+		return nil
+	}
+
+	//heading from each point to the next. Points that don't move keep the last heading.
+	headings := make([]float64, len(pts))
+	for i := 0; i < len(pts)-1; i++ {
+		if pts[i].Distance(pts[i+1]) < minHeadingMove && i > 0 {
+			headings[i] = headings[i-1]
+		} else {
+			headings[i] = bearing(pts[i], pts[i+1])
+		}
+	}
+	headings[len(pts)-1] = headings[len(pts)-2]
+
+	//turned[i] is how much we have turned from the first point up to point i
+	turned := make([]float64, len(pts))
+	for i := 1; i < len(pts); i++ {
+		turned[i] = turned[i-1] + turnAngle(headings[i-1], headings[i])
+	}
+
+	//circling when the turn rate over the next turnWindow is high enough
+	circling := make([]bool, len(pts))
+	j := 0
+	for i := range pts {
+		for j < len(pts)-1 && times[j].Sub(times[i]) < turnWindow {
+			j++
+		}
+		dt := times[j].Sub(times[i]).Seconds()
+		if dt > 0 {
+			circling[i] = math.Abs(turned[j]-turned[i])/dt >= circlingRate
+		} else if i > 0 {
+			circling[i] = circling[i-1]
+		}
+	}
+
+	//runs of the same kind
+	var phases []phase
+	for i := range pts {
+		if len(phases) > 0 && phases[len(phases)-1].circling == circling[i] {
+			phases[len(phases)-1].end = i
+		} else {
+			phases = append(phases, phase{i, i, circling[i]})
+		}
+	}
+
+	//short phases are noise: give them to the phase before (or after, for the first one),
+	//then join phases of the same kind
+	for k := range phases {
+		if times[phases[k].end].Sub(times[phases[k].start]) >= minPhase {
+			continue
+		}
+		if k > 0 {
+			phases[k].circling = phases[k-1].circling
+		} else if len(phases) > 1 {
+			phases[k].circling = phases[k+1].circling
+		}
+	}
+	var merged []phase
+	for _, p := range phases {
+		if len(merged) > 0 && merged[len(merged)-1].circling == p.circling {
+			merged[len(merged)-1].end = p.end
+		} else {
+			merged = append(merged, p)
+		}
+	}
+	return merged
+}
+
+//computePhases describes every thermal and glide in pts
+func computePhases(pts []igc.Point, times []time.Time) FlightPhases {
+	fp := FlightPhases{Thermals: []Thermal{}, Glides: []Glide{}}
+	var circlingTime, totalTime time.Duration
+
+	for _, ph := range findPhases(pts, times) {
+		//phases share their edge point with the next one, so no time is lost between them
+		end := ph.end
+		if end < len(pts)-1 {
+			end++
+		}
+		a, b := pts[ph.start], pts[end]
+		dur := times[end].Sub(times[ph.start])
+		hours := dur.Hours()
+		dist := a.Distance(b)
+		totalTime += dur
+
+		if ph.circling {
+			circlingTime += dur
+			th := Thermal{
+				Entry:          times[ph.start],
+				Exit:           times[end],
+				Duration:       isoDuration(dur),
+				Direction:      "right",
+				AltitudeGain:   b.PressureAltitude - a.PressureAltitude,
+				DriftDistance:  dist,
+				DriftDirection: bearing(a, b),
+			}
+			if turnedBetween(pts, ph.start, end) < 0 {
+				th.Direction = "left"
+			}
+			if dur > 0 {
+				th.AvgClimb = float64(th.AltitudeGain) / dur.Seconds()
+				th.DriftSpeed = dist / hours
+			}
+			fp.Thermals = append(fp.Thermals, th)
+			continue
+		}
+
+		gl := Glide{
+			Start:        times[ph.start],
+			End:          times[end],
+			Duration:     isoDuration(dur),
+			Distance:     dist,
+			AltitudeLoss: a.PressureAltitude - b.PressureAltitude,
+		}
+		if gl.AltitudeLoss > 0 {
+			ld := dist * 1000 / float64(gl.AltitudeLoss)
+			gl.LD = &ld
+		}
+		if dur > 0 {
+			gl.Speed = dist / hours
+		}
+		fp.Glides = append(fp.Glides, gl)
+	}
+
+	if totalTime > 0 {
+		fp.CirclingPercent = 100 * circlingTime.Seconds() / totalTime.Seconds()
+	}
+	return fp
+}
+
+//turnedBetween is the total turn in degrees from point a to point b, positive to the right
+func turnedBetween(pts []igc.Point, a, b int) float64 {
+	total := 0.0
+	for i := a + 1; i < b; i++ {
+		total += turnAngle(bearing(pts[i-1], pts[i]), bearing(pts[i], pts[i+1]))
+	}
+	return total
+}
+
+//writes the thermals and glides of a track
+func (s *server) handlAPIigcIDphases(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	rec, err := s.store.Get(vars["ID"])
+	if err != nil {
+		errorHandler(w, http.StatusNotFound, fmt.Sprintf("Error: %s", err))
+		return
+	}
+	writeJSON(w, computePhases(rec.flightPoints(includeGround(r))))
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	igc "github.com/marni/goigc"
+)
+
+//TrackPoint is one fix, as the points endpoint shows it
+type TrackPoint struct {
+	Time             time.Time         `json:"time"`
+	Lat              float64           `json:"lat"`
+	Lng              float64           `json:"lng"`
+	PressureAltitude int64             `json:"pressure_altitude"`
+	GNSSAltitude     int64             `json:"gnss_altitude"`
+	FixValidity      string            `json:"fix_validity"`
+	Satellites       int               `json:"satellites"`
+	IData            map[string]string `json:"idata,omitempty"` //extensions from the I record, like FXA
+}
+
+//PointSlice is the fixes of a track picked out by a pointQuery
+type PointSlice struct {
+	Matched int          `json:"matched"` //fixes passing the filters, before thinning
+	Count   int          `json:"count"`   //fixes given
+	Points  []TrackPoint `json:"points"`
+}
+
+//pointQuery says which fixes of a track to give
+type pointQuery struct {
+	from, to  time.Time //both inclusive. Zero when not given.
+	bbox      bool
+	minLat    float64
+	minLng    float64
+	maxLat    float64
+	maxLng    float64
+	step      int //give every step'th fix
+	maxPoints int //then thin to this many. 0 for no limit.
+}
+
+//parsePointQuery reads the parameters of the points endpoint.
+//start is the time of the first fix, to place times without a date.
+func parsePointQuery(q url.Values, start time.Time) (pointQuery, error) {
+	pq := pointQuery{step: 1}
+	var err error
+
+	for _, t := range []struct {
+		name string
+		at   *time.Time
+	}{{"from", &pq.from}, {"to", &pq.to}} {
+		v := q.Get(t.name)
+		if v == "" {
+			continue
+		}
+		*t.at, err = parsePointTime(v, start)
+		if err != nil {
+			return pq, fmt.Errorf("%s must be a time like 2018-07-02T10:30:00Z or 10:30:00", t.name)
+		}
+	}
+
+	if v := q.Get("bbox"); v != "" {
+		parts := strings.Split(v, ",")
+		var nums [4]float64
+		if len(parts) != 4 {
+			return pq, fmt.Errorf("bbox must be min_lng,min_lat,max_lng,max_lat")
+		}
+		for i, p := range parts {
+			nums[i], err = strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil {
+				return pq, fmt.Errorf("bbox must be min_lng,min_lat,max_lng,max_lat")
+			}
+		}
+		pq.bbox = true
+		pq.minLng, pq.minLat, pq.maxLng, pq.maxLat = nums[0], nums[1], nums[2], nums[3]
+		if pq.minLat > pq.maxLat || pq.minLng > pq.maxLng {
+			return pq, fmt.Errorf("bbox minimums must be less than the maximums")
+		}
+	}
+
+	if v := q.Get("step"); v != "" {
+		pq.step, err = strconv.Atoi(v)
+		if err != nil || pq.step < 1 {
+			return pq, fmt.Errorf("step must be a number from 1")
+		}
+	}
+	if v := q.Get("max_points"); v != "" {
+		pq.maxPoints, err = strconv.Atoi(v)
+		if err != nil || pq.maxPoints < 2 {
+			return pq, fmt.Errorf("max_points must be a number from 2")
+		}
+	}
+	return pq, nil
+}
+
+//parsePointTime reads a full time, or a time of day. Times of day are on
+//the day of start, or the day after if they are before start.
+func parsePointTime(v string, start time.Time) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, v)
+	if err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		t, err = time.Parse(layout, v)
+		if err == nil {
+			y, m, d := start.Date()
+			at := time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+			if at.Before(start) {
+				at = at.AddDate(0, 0, 1) //after midnight
+			}
+			return at, nil
+		}
+	}
+	return t, err
+}
+
+//matches reports if fix p taken at t passes the filters of pq
+func (pq pointQuery) matches(p igc.Point, t time.Time) bool {
+	if !pq.from.IsZero() && t.Before(pq.from) {
+		return false
+	}
+	if !pq.to.IsZero() && t.After(pq.to) {
+		return false
+	}
+	if pq.bbox {
+		lat, lng := p.Lat.Degrees(), p.Lng.Degrees()
+		if lat < pq.minLat || lat > pq.maxLat || lng < pq.minLng || lng > pq.maxLng {
+			return false
+		}
+	}
+	return true
+}
+
+//slicePoints picks the fixes of pts that pq asks for
+func slicePoints(pts []igc.Point, times []time.Time, pq pointQuery) PointSlice {
+	var picked []int
+	for i, p := range pts {
+		if pq.matches(p, times[i]) {
+			picked = append(picked, i)
+		}
+	}
+	ps := PointSlice{Matched: len(picked), Points: []TrackPoint{}}
+
+	var kept []int
+	for k := 0; k < len(picked); k += pq.step {
+		kept = append(kept, picked[k])
+	}
+	if pq.maxPoints > 0 && len(kept) > pq.maxPoints {
+		thinned := make([]int, 0, pq.maxPoints)
+		for _, k := range thinIndexes(len(kept), pq.maxPoints) {
+			thinned = append(thinned, kept[k])
+		}
+		kept = thinned
+	}
+
+	for _, i := range kept {
+		ps.Points = append(ps.Points, newTrackPoint(pts[i], times[i]))
+	}
+	ps.Count = len(ps.Points)
+	return ps
+}
+
+//newTrackPoint makes a TrackPoint of fix p, taken at t
+func newTrackPoint(p igc.Point, t time.Time) TrackPoint {
+	tp := TrackPoint{
+		Time:             t,
+		Lat:              p.Lat.Degrees(),
+		Lng:              p.Lng.Degrees(),
+		PressureAltitude: p.PressureAltitude,
+		GNSSAltitude:     p.GNSSAltitude,
+		Satellites:       p.NumSatellites,
+	}
+	if p.FixValidity != 0 {
+		tp.FixValidity = string(p.FixValidity)
+	}
+	if len(p.IData) > 0 {
+		tp.IData = p.IData
+	}
+	return tp
+}
+
+//writes the fixes of a track, picked by time, place and thinning
+func (s *server) handlAPIigcIDpoints(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	rec, err := s.store.Get(vars["ID"])
+	if err != nil {
+		errorHandler(w, http.StatusNotFound, fmt.Sprintf("Error: %s", err))
+		return
+	}
+	times := pointTimes(rec.Track)
+	start := rec.Track.Date
+	if len(times) > 0 {
+		start = times[0]
+	}
+	pq, err := parsePointQuery(r.URL.Query(), start)
+	if err != nil {
+		errorHandler(w, http.StatusBadRequest, fmt.Sprintf("Error: %s", err))
+		return
+	}
+	writeJSON(w, slicePoints(rec.Track.Points, times, pq))
+}
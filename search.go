@@ -0,0 +1,385 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	igc "github.com/marni/goigc"
+)
+
+//searchDoc is what the search index knows about one track
+type searchDoc struct {
+	id         string
+	registered time.Time
+	text       map[string]string //lower case header fields, by the name used in queries
+	date       string            //flight date as 2006-01-02
+	length     float64           //track length in km, in flight
+	duration   time.Duration     //time from takeoff to landing
+}
+
+//searchTextFields are the header fields that can be searched, by query name
+var searchTextFields = map[string]func(h igc.Header) string{
+	"pilot":        func(h igc.Header) string { return h.Pilot },
+	"crew":         func(h igc.Header) string { return h.Crew },
+	"glider":       func(h igc.Header) string { return h.GliderType },
+	"glider_id":    func(h igc.Header) string { return h.GliderID },
+	"comp_id":      func(h igc.Header) string { return h.CompetitionID },
+	"class":        func(h igc.Header) string { return h.CompetitionClass },
+	"manufacturer": func(h igc.Header) string { return h.Manufacturer },
+}
+
+//searchIndex finds tracks by their header fields and stats.
+//Words in text fields are indexed so free text queries don't look at every track.
+type searchIndex struct {
+	mu    sync.RWMutex
+	docs  map[string]*searchDoc
+	words map[string]map[string]bool //word -> IDs of tracks having it
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		docs:  make(map[string]*searchDoc),
+		words: make(map[string]map[string]bool),
+	}
+}
+
+//add puts rec in the index, replacing what was there for its ID
+func (x *searchIndex) add(rec trackRecord) {
+	doc := &searchDoc{
+		id:         rec.ID,
+		registered: rec.Registered,
+		text:       make(map[string]string),
+		date:       rec.Track.Date.Format("2006-01-02"),
+		length:     rec.Stats.TrackLength,
+		duration:   rec.Stats.flightTime,
+	}
+	for name, get := range searchTextFields {
+		doc.text[name] = strings.ToLower(get(rec.Track.Header))
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.removeLocked(rec.ID)
+	x.docs[rec.ID] = doc
+	for _, text := range doc.text {
+		for _, w := range searchWords(text) {
+			if x.words[w] == nil {
+				x.words[w] = make(map[string]bool)
+			}
+			x.words[w][rec.ID] = true
+		}
+	}
+}
+
+//remove takes the track with the given id out of the index
+func (x *searchIndex) remove(id string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.removeLocked(id)
+}
+
+func (x *searchIndex) removeLocked(id string) {
+	doc, ok := x.docs[id]
+	if !ok {
+		return
+	}
+	for _, text := range doc.text {
+		for _, w := range searchWords(text) {
+			delete(x.words[w], id)
+			if len(x.words[w]) == 0 {
+				delete(x.words, w)
+			}
+		}
+	}
+	delete(x.docs, id)
+}
+
+//search gives the IDs of all tracks matching q, in the order they were registered
+func (x *searchIndex) search(q searchQuery) []string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	//start from the tracks having every free text word, or all of them
+	var candidates []*searchDoc
+	if len(q.words) > 0 {
+		for id := range x.words[q.words[0]] {
+			candidates = append(candidates, x.docs[id])
+		}
+	} else {
+		for _, doc := range x.docs {
+			candidates = append(candidates, doc)
+		}
+	}
+
+	var hits []*searchDoc
+	for _, doc := range candidates {
+		if q.matches(x, doc) {
+			hits = append(hits, doc)
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if !hits[i].registered.Equal(hits[j].registered) {
+			return hits[i].registered.Before(hits[j].registered)
+		}
+		return hits[i].id < hits[j].id
+	})
+
+	ids := make([]string, len(hits))
+	for i := range hits {
+		ids[i] = hits[i].id
+	}
+	return ids
+}
+
+//searchWords splits text into lower case words
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+//searchTerm is one field condition in a query, like length>100
+type searchTerm struct {
+	field string
+	op    string //one of : = > < >= <=
+	value string
+	num   float64       //value as a number, for length
+	dur   time.Duration //value as a duration, for duration
+}
+
+//searchQuery is a parsed query. Every part must match.
+type searchQuery struct {
+	words []string //free text words, found in any text field
+	terms []searchTerm
+}
+
+//searchOps are the operators a term can have. The first one in a term splits
+//it, so values can hold operators too. Longer ones are listed first, so >= wins over >.
+var searchOps = []string{">=", "<=", ":", "=", ">", "<"}
+
+//parseSearchQuery reads queries like
+//
+//	pilot:"john doe" glider:ventus date:2018-07 length>=300 duration>4h standard
+//
+//field:value matches text fields that contain value, and dates starting with it.
+//Bare words must be a whole word in any text field. Case is ignored.
+//length and duration are of the flight, without ground time.
+func parseSearchQuery(s string) (searchQuery, error) {
+	var q searchQuery
+	parts, err := splitQuery(s)
+	if err != nil {
+		return q, err
+	}
+
+	for _, part := range parts {
+		field, op, value := "", "", ""
+		at := -1
+		for _, o := range searchOps {
+			if i := strings.Index(part, o); i > 0 && (at < 0 || i < at) {
+				at, op = i, o
+			}
+		}
+		if op != "" {
+			field, value = strings.ToLower(part[:at]), part[at+len(op):]
+		}
+		if op == "" {
+			q.words = append(q.words, searchWords(part)...)
+			continue
+		}
+
+		term := searchTerm{field: field, op: op, value: strings.ToLower(value)}
+		switch {
+		case searchTextFields[field] != nil:
+			if op != ":" && op != "=" {
+				return q, fmt.Errorf("%s can only be used with : or =", field)
+			}
+		case field == "date":
+			//compared as text, which works for 2006-01-02
+		case field == "length":
+			term.num, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				return q, fmt.Errorf("length must be a number of km, not %q", value)
+			}
+		case field == "duration":
+			term.dur, err = time.ParseDuration(value)
+			if err != nil {
+				return q, fmt.Errorf("duration must be like 2h30m, not %q", value)
+			}
+		default:
+			return q, fmt.Errorf("unknown field %q", field)
+		}
+		q.terms = append(q.terms, term)
+	}
+	return q, nil
+}
+
+//splitQuery splits s on spaces, keeping "quoted text" together
+func splitQuery(s string) ([]string, error) {
+	var parts []string
+	var cur strings.Builder
+	quoted := false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case unicode.IsSpace(r) && !quoted:
+			if cur.Len() > 0 {
+				parts = append(parts, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("missing closing quote")
+	}
+	if cur.Len() > 0 {
+		parts = append(parts, cur.String())
+	}
+	return parts, nil
+}
+
+//matches reports if doc has every word and passes every term in q
+func (q searchQuery) matches(x *searchIndex, doc *searchDoc) bool {
+	for _, w := range q.words {
+		if !x.words[w][doc.id] {
+			return false
+		}
+	}
+	for _, t := range q.terms {
+		if !t.matches(doc) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t searchTerm) matches(doc *searchDoc) bool {
+	switch t.field {
+	case "date":
+		if t.op == ":" || t.op == "=" {
+			return strings.HasPrefix(doc.date, t.value)
+		}
+		return compare(strings.Compare(doc.date, t.value), t.op)
+	case "length":
+		return compare(compareFloat(doc.length, t.num), t.op)
+	case "duration":
+		return compare(compareFloat(float64(doc.duration), float64(t.dur)), t.op)
+	default:
+		return strings.Contains(doc.text[t.field], t.value)
+	}
+}
+
+//compare says if c, the result of comparing a with b, satisfies a op b
+func compare(c int, op string) bool {
+	switch op {
+	case ">":
+		return c > 0
+	case "<":
+		return c < 0
+	case ">=":
+		return c >= 0
+	case "<=":
+		return c <= 0
+	default:
+		return c == 0
+	}
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+//writes the IDs of tracks matching the query in q
+func (s *server) handlAPIsearch(w http.ResponseWriter, r *http.Request) {
+	q, err := parseSearchQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		errorHandler(w, http.StatusBadRequest, fmt.Sprintf("Query error: %s", err))
+		return
+	}
+
+	limit := defaultListLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			str := fmt.Sprintf("Error: limit must be a number from 1 to %d", maxListLimit)
+			errorHandler(w, http.StatusBadRequest, str)
+			return
+		}
+	}
+
+	ids := s.index.search(q)
+	page := TrackPage{IDs: ids, Total: len(ids)}
+	if len(page.IDs) > limit {
+		page.IDs = page.IDs[:limit]
+	}
+	writeJSON(w, page)
+}
+
+//indexedStore is a TrackStore that keeps a searchIndex up to date
+//with the live tracks in the store it wraps.
+type indexedStore struct {
+	TrackStore
+	index *searchIndex
+}
+
+//newIndexedStore wraps store, and indexes the tracks already in it
+func newIndexedStore(store TrackStore, index *searchIndex) *indexedStore {
+	for _, id := range store.List() {
+		rec, err := store.Get(id)
+		if err == nil {
+			index.add(rec)
+		}
+	}
+	return &indexedStore{store, index}
+}
+
+func (s *indexedStore) Put(rec trackRecord) error {
+	err := s.TrackStore.Put(rec)
+	if err == nil {
+		s.index.add(rec)
+	}
+	return err
+}
+
+func (s *indexedStore) Delete(id string) error {
+	err := s.TrackStore.Delete(id)
+	if err == nil {
+		s.index.remove(id)
+	}
+	return err
+}
+
+func (s *indexedStore) SoftDelete(id string, at time.Time) error {
+	err := s.TrackStore.SoftDelete(id, at)
+	if err == nil {
+		s.index.remove(id)
+	}
+	return err
+}
+
+func (s *indexedStore) Restore(id string) error {
+	err := s.TrackStore.Restore(id)
+	if err != nil {
+		return err
+	}
+	rec, err := s.TrackStore.Get(id)
+	if err == nil {
+		s.index.add(rec)
+	}
+	return nil
+}
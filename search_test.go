@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	cases := []struct {
+		query string
+		terms []searchTerm
+		words []string
+	}{
+		{`length>=300`, []searchTerm{{field: "length", op: ">=", value: "300", num: 300}}, nil},
+		{`length>300`, []searchTerm{{field: "length", op: ">", value: "300", num: 300}}, nil},
+		{`duration<=2h`, []searchTerm{{field: "duration", op: "<=", value: "2h", dur: 2 * time.Hour}}, nil},
+		//the first operator splits the term, the rest is value
+		{`pilot:a>b`, []searchTerm{{field: "pilot", op: ":", value: "a>b"}}, nil},
+		{`pilot:"o>=x"`, []searchTerm{{field: "pilot", op: ":", value: "o>=x"}}, nil},
+		{`glider=a:b`, []searchTerm{{field: "glider", op: "=", value: "a:b"}}, nil},
+		{`date<2018-08-01`, []searchTerm{{field: "date", op: "<", value: "2018-08-01"}}, nil},
+		{`Ventus standard`, nil, []string{"ventus", "standard"}},
+		{`pilot:"John Doe" ventus`, []searchTerm{{field: "pilot", op: ":", value: "john doe"}}, []string{"ventus"}},
+	}
+	for _, c := range cases {
+		q, err := parseSearchQuery(c.query)
+		if err != nil {
+			t.Errorf("%s: %s", c.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(q.terms, c.terms) || !reflect.DeepEqual(q.words, c.words) {
+			t.Errorf("%s gave terms %+v words %q, want %+v %q", c.query, q.terms, q.words, c.terms, c.words)
+		}
+	}
+}
+
+func TestParseSearchQueryErrors(t *testing.T) {
+	for _, query := range []string{
+		`pilot>a`,
+		`length>=far`,
+		`duration<=long`,
+		`altitude>100`,
+		`pilot:"unclosed`,
+	} {
+		if _, err := parseSearchQuery(query); err == nil {
+			t.Errorf("%s gave no error", query)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	igc "github.com/marni/goigc"
+)
+
+//defaultTolerance is how far in metres a simplified track may stray from the real one
+const defaultTolerance = 20.0
+
+//SimplifiedTrack is a track with fewer points, for drawing on maps
+type SimplifiedTrack struct {
+	Tolerance        float64      `json:"tolerance"`         //metres, as asked for
+	Original         int          `json:"original"`          //fixes in the track
+	Retained         int          `json:"retained"`          //fixes kept
+	MaxError         float64      `json:"max_error"`         //metres, the furthest a dropped fix is from the simplified line
+	TrackLength      float64      `json:"track_length"`      //km, of every fix
+	SimplifiedLength float64      `json:"simplified_length"` //km, of the fixes kept
+	Points           []TrackPoint `json:"points"`
+}
+
+//simplify keeps the fixes of pts needed to stay within tolerance metres of
+//the track, with Douglas-Peucker. Only the horizontal position is looked at.
+//It gives the indexes kept, and the largest distance of a dropped fix from the line.
+func simplify(pts []igc.Point, tolerance float64) ([]int, float64) {
+	if len(pts) < 3 {
+		idx := make([]int, len(pts))
+		for i := range idx {
+			idx[i] = i
+		}
+		return idx, 0
+	}
+
+	//flat x, y in metres around the first fix. Plenty good for a single flight.
+	xs, ys := make([]float64, len(pts)), make([]float64, len(pts))
+	for i, p := range pts {
+		xs[i], ys[i] = localXY(pts[0], p)
+		xs[i] *= 1000
+		ys[i] *= 1000
+	}
+
+	keep := make([]bool, len(pts))
+	keep[0], keep[len(pts)-1] = true, true
+	maxErr := 0.0
+
+	//ranges still to look at, first and last fix. A stack instead of recursion,
+	//since long flights could go deep.
+	stack := [][2]int{{0, len(pts) - 1}}
+	for len(stack) > 0 {
+		a, b := stack[len(stack)-1][0], stack[len(stack)-1][1]
+		stack = stack[:len(stack)-1]
+
+		far, farDist := -1, 0.0
+		for i := a + 1; i < b; i++ {
+			d := segmentDistance(xs[i], ys[i], xs[a], ys[a], xs[b], ys[b])
+			if d > farDist {
+				far, farDist = i, d
+			}
+		}
+		if far < 0 || farDist <= tolerance {
+			//everything between a and b is dropped
+			maxErr = math.Max(maxErr, farDist)
+			continue
+		}
+		keep[far] = true
+		stack = append(stack, [2]int{a, far}, [2]int{far, b})
+	}
+
+	var idx []int
+	for i, k := range keep {
+		if k {
+			idx = append(idx, i)
+		}
+	}
+	return idx, maxErr
+}
+
+//segmentDistance is how far point p is from the segment a-b
+func segmentDistance(px, py, ax, ay, bx, by float64) float64 {
+	dx, dy := bx-ax, by-ay
+	if dx == 0 && dy == 0 {
+		return math.Hypot(px-ax, py-ay)
+	}
+	//where along the segment p is closest, from 0 at a to 1 at b
+	f := ((px-ax)*dx + (py-ay)*dy) / (dx*dx + dy*dy)
+	f = math.Max(0, math.Min(1, f))
+	return math.Hypot(px-(ax+f*dx), py-(ay+f*dy))
+}
+
+//pathLength is the length in km of the path through pts at idx
+func pathLength(pts []igc.Point, idx []int) float64 {
+	d := 0.0
+	for k := 1; k < len(idx); k++ {
+		d += pts[idx[k-1]].Distance(pts[idx[k]])
+	}
+	return d
+}
+
+//newSimplifiedTrack simplifies pts, taken at times, to within tolerance metres
+func newSimplifiedTrack(pts []igc.Point, times []time.Time, tolerance float64) SimplifiedTrack {
+	idx, maxErr := simplify(pts, tolerance)
+	all := make([]int, len(pts))
+	for i := range all {
+		all[i] = i
+	}
+
+	st := SimplifiedTrack{
+		Tolerance:        tolerance,
+		Original:         len(pts),
+		Retained:         len(idx),
+		MaxError:         maxErr,
+		TrackLength:      pathLength(pts, all),
+		SimplifiedLength: pathLength(pts, idx),
+		Points:           []TrackPoint{},
+	}
+	for _, i := range idx {
+		st.Points = append(st.Points, newTrackPoint(pts[i], times[i]))
+	}
+	return st
+}
+
+//writes a track with fewer points, within ?tolerance= metres of the real one
+func (s *server) handlAPIigcIDsimplify(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	tolerance := defaultTolerance
+	if v := r.URL.Query().Get("tolerance"); v != "" {
+		t, err := strconv.ParseFloat(v, 64)
+		if err != nil || t < 0 || math.IsInf(t, 0) || math.IsNaN(t) {
+			errorHandler(w, http.StatusBadRequest, "Error: tolerance must be a number of metres, 0 or more")
+			return
+		}
+		tolerance = t
+	}
+
+	rec, err := s.store.Get(vars["ID"])
+	if err != nil {
+		errorHandler(w, http.StatusNotFound, fmt.Sprintf("Error: %s", err))
+		return
+	}
+	writeJSON(w, newSimplifiedTrack(rec.Track.Points, pointTimes(rec.Track), tolerance))
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	igc "github.com/marni/goigc"
+)
+
+//rateWindow is how far apart fixes must be when working out speeds and
+//climb rates, so single noisy fixes don't give silly numbers
+const rateWindow = 10 * time.Second
+
+//FlightStats sums up a flight, or the whole recording when asked to include
+//ground time. Altitudes are in metres, distances in km, speeds in km/h and
+//climb rates in m/s.
+type FlightStats struct {
+	Takeoff             time.Time `json:"takeoff"`
+	Landing             time.Time `json:"landing"`
+	Duration            string    `json:"duration"` //ISO8601, like PT2H30M0S
+	MaxGNSSAltitude     int64     `json:"max_gnss_altitude"`
+	MinGNSSAltitude     int64     `json:"min_gnss_altitude"`
+	MaxPressureAltitude int64     `json:"max_pressure_altitude"`
+	MinPressureAltitude int64     `json:"min_pressure_altitude"`
+	AltitudeGain        int64     `json:"altitude_gain"` //sum of all climbs, pressure altitude
+	MaxClimb            float64   `json:"max_climb"`
+	MaxSink             float64   `json:"max_sink"` //positive number, fastest descent
+	AvgGroundSpeed      float64   `json:"avg_ground_speed"`
+	MaxGroundSpeed      float64   `json:"max_ground_speed"`
+	StraightDistance    float64   `json:"straight_distance"` //takeoff to landing
+	FreeDistance        float64   `json:"free_distance"`     //furthest point from takeoff
+	TrackLength         float64   `json:"track_length"`      //sum of distances between points
+
+	flightTime time.Duration //same as Duration, for sorting and searching
+}
+
+//midnightJump is how far the clock must go back between two points before
+//we take it as passing midnight. Smaller steps back are loggers writing
+//fixes a little out of order, and stay on the same day.
+const midnightJump = 12 * time.Hour
+
+//pointTimes gives the full time of every point in t. Points only have
+//the time of day, so the date comes from the header, and a day is added
+//every time the clock passes midnight.
+func pointTimes(t igc.Track) []time.Time {
+	times := make([]time.Time, len(t.Points))
+	y, m, d := t.Date.Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	var prev time.Duration
+	for i, p := range t.Points {
+		h, mi, s := p.Time.Clock()
+		tod := time.Duration(h)*time.Hour + time.Duration(mi)*time.Minute + time.Duration(s)*time.Second
+		if i > 0 && prev-tod > midnightJump {
+			day = day.AddDate(0, 0, 1)
+		}
+		prev = tod
+		times[i] = day.Add(tod)
+	}
+	return times
+}
+
+//isoDuration writes d in the same ISO8601 style as our uptime
+func isoDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	h := int(d / time.Hour)
+	m := int(d % time.Hour / time.Minute)
+	s := int(d % time.Minute / time.Second)
+	return fmt.Sprintf("PT%dH%dM%dS", h, m, s)
+}
+
+//computeStats works out the FlightStats of pts, which were recorded at times
+func computeStats(pts []igc.Point, times []time.Time) FlightStats {
+	var st FlightStats
+	if len(pts) == 0 {
+		st.Duration = isoDuration(0)
+		return st
+	}
+
+	st.Takeoff = times[0]
+	st.Landing = times[len(pts)-1]
+	st.flightTime = st.Landing.Sub(st.Takeoff)
+	st.Duration = isoDuration(st.flightTime)
+
+	st.MinPressureAltitude = math.MaxInt64
+	st.MaxPressureAltitude = math.MinInt64
+	st.MinGNSSAltitude = math.MaxInt64
+	st.MaxGNSSAltitude = math.MinInt64
+	gnss := false
+	for i, p := range pts {
+		if p.PressureAltitude < st.MinPressureAltitude {
+			st.MinPressureAltitude = p.PressureAltitude
+		}
+		if p.PressureAltitude > st.MaxPressureAltitude {
+			st.MaxPressureAltitude = p.PressureAltitude
+		}
+		//only 3D fixes have a GNSS altitude worth anything
+		if p.FixValidity == 'A' {
+			gnss = true
+			if p.GNSSAltitude < st.MinGNSSAltitude {
+				st.MinGNSSAltitude = p.GNSSAltitude
+			}
+			if p.GNSSAltitude > st.MaxGNSSAltitude {
+				st.MaxGNSSAltitude = p.GNSSAltitude
+			}
+		}
+		if i > 0 && p.PressureAltitude > pts[i-1].PressureAltitude {
+			st.AltitudeGain += p.PressureAltitude - pts[i-1].PressureAltitude
+		}
+		if d := pts[0].Distance(p); d > st.FreeDistance {
+			st.FreeDistance = d
+		}
+	}
+	if !gnss {
+		st.MinGNSSAltitude, st.MaxGNSSAltitude = 0, 0
+	}
+
+	st.StraightDistance = pts[0].Distance(pts[len(pts)-1])
+
+	//distance flown up to each point
+	flown := make([]float64, len(pts))
+	for i := 1; i < len(pts); i++ {
+		flown[i] = flown[i-1] + pts[i-1].Distance(pts[i])
+	}
+
+	st.TrackLength = flown[len(pts)-1]
+	if st.flightTime > 0 {
+		st.AvgGroundSpeed = st.TrackLength / st.flightTime.Hours()
+	}
+
+	//speeds and climb rates over windows of at least rateWindow
+	j := 0
+	for i := range pts {
+		for j < len(pts) && times[j].Sub(times[i]) < rateWindow {
+			j++
+		}
+		if j == len(pts) {
+			break
+		}
+		dt := times[j].Sub(times[i]).Seconds()
+		if speed := (flown[j] - flown[i]) / dt * 3600; speed > st.MaxGroundSpeed {
+			st.MaxGroundSpeed = speed
+		}
+		vario := float64(pts[j].PressureAltitude-pts[i].PressureAltitude) / dt
+		if vario > st.MaxClimb {
+			st.MaxClimb = vario
+		}
+		if -vario > st.MaxSink {
+			st.MaxSink = -vario
+		}
+	}
+	return st
+}
+
+//writes the flight statistics of a track. Ground time before takeoff and
+//after landing is left out, unless ?include_ground=true
+func (s *server) handlAPIigcIDstats(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	rec, err := s.store.Get(vars["ID"])
+	if err != nil {
+		errorHandler(w, http.StatusNotFound, fmt.Sprintf("Error: %s", err))
+		return
+	}
+	writeJSON(w, rec.view(includeGround(r)).Stats)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	igc "github.com/marni/goigc"
+)
+
+//clockTrack makes a track on 2018-07-02 with points at the given times of day
+func clockTrack(clocks ...string) igc.Track {
+	var t igc.Track
+	t.Date = time.Date(2018, 7, 2, 0, 0, 0, 0, time.UTC)
+	for _, c := range clocks {
+		tod, err := time.Parse("15:04:05", c)
+		if err != nil {
+			panic(err)
+		}
+		p := igc.NewPoint()
+		p.Time = tod
+		t.Points = append(t.Points, p)
+	}
+	return t
+}
+
+func TestPointTimes(t *testing.T) {
+	cases := []struct {
+		name   string
+		clocks []string
+		want   []string
+	}{
+		{
+			"same day",
+			[]string{"10:00:00", "10:00:01", "12:30:00"},
+			[]string{"2018-07-02T10:00:00Z", "2018-07-02T10:00:01Z", "2018-07-02T12:30:00Z"},
+		},
+		{
+			"crossing midnight",
+			[]string{"23:59:58", "23:59:59", "00:00:00", "00:00:01", "01:30:00"},
+			[]string{"2018-07-02T23:59:58Z", "2018-07-02T23:59:59Z", "2018-07-03T00:00:00Z", "2018-07-03T00:00:01Z", "2018-07-03T01:30:00Z"},
+		},
+		{
+			//loggers sometimes write fixes a little out of order
+			"clock one second back",
+			[]string{"10:00:00", "10:00:02", "10:00:01", "10:00:03"},
+			[]string{"2018-07-02T10:00:00Z", "2018-07-02T10:00:02Z", "2018-07-02T10:00:01Z", "2018-07-02T10:00:03Z"},
+		},
+		{
+			"clock two seconds back",
+			[]string{"10:00:00", "10:00:04", "10:00:02", "10:00:05"},
+			[]string{"2018-07-02T10:00:00Z", "2018-07-02T10:00:04Z", "2018-07-02T10:00:02Z", "2018-07-02T10:00:05Z"},
+		},
+		{
+			"repeated second",
+			[]string{"10:00:00", "10:00:01", "10:00:01", "10:00:02"},
+			[]string{"2018-07-02T10:00:00Z", "2018-07-02T10:00:01Z", "2018-07-02T10:00:01Z", "2018-07-02T10:00:02Z"},
+		},
+		{
+			"clock back around midnight",
+			[]string{"23:59:59", "00:00:01", "00:00:00", "00:00:02"},
+			[]string{"2018-07-02T23:59:59Z", "2018-07-03T00:00:01Z", "2018-07-03T00:00:00Z", "2018-07-03T00:00:02Z"},
+		},
+	}
+	for _, c := range cases {
+		got := pointTimes(clockTrack(c.clocks...))
+		if len(got) != len(c.want) {
+			t.Fatalf("%s: got %d times, want %d", c.name, len(got), len(c.want))
+		}
+		for i, want := range c.want {
+			if s := got[i].Format(time.RFC3339); s != want {
+				t.Errorf("%s: point %d at %s, want %s", c.name, i, s, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	igc "github.com/marni/goigc"
+)
+
+//errAlreadyRegistered is returned by Put when the ID is taken
+var errAlreadyRegistered = errors.New("Already registered")
+
+//errTrackDeleted is returned by Put when the track is registered, but deleted
+var errTrackDeleted = errors.New("Track is deleted, it can be restored by an admin")
+
+//errTrackNotFound is returned when no track has the given ID
+var errTrackNotFound = errors.New("Did not find track")
+
+//trackRecord is a registered track with everything we keep about it
+type trackRecord struct {
+	ID         string
+	Track      igc.Track
+	Raw        []byte         //the IGC file as we recieved it
+	Registered time.Time      //when it was registered with us
+	Deleted    time.Time      //when it was soft deleted. Zero if it's not.
+	Flight     flightInterval //the part of the track spent in the air
+	Stats      FlightStats    //of the flight only
+	AllStats   FlightStats    //of the whole track, ground time included
+}
+
+//newTrackRecord makes a record of track, working out everything we keep about it
+func newTrackRecord(id string, track igc.Track, raw []byte, registered time.Time) trackRecord {
+	times := pointTimes(track)
+	flight := detectFlight(track.Points, times)
+	rec := trackRecord{
+		ID:         id,
+		Track:      track,
+		Raw:        raw,
+		Registered: registered,
+		Flight:     flight,
+		AllStats:   computeStats(track.Points, times),
+	}
+	rec.Stats = rec.AllStats
+	if flight.Detected {
+		rec.Stats = computeStats(track.Points[flight.Start:flight.End+1], times[flight.Start:flight.End+1])
+	}
+	return rec
+}
+
+//TrackStore keeps registered tracks. Handlers only talk to this,
+//so the backend can be swapped without touching them.
+//
+//Tracks can be soft deleted. They are then hidden from Get, List and
+//Exists until they are restored, or removed for good with Delete.
+type TrackStore interface {
+	//Put registers a track under rec.ID. Fails with errAlreadyRegistered on
+	//duplicates, or errTrackDeleted if the duplicate is soft deleted.
+	Put(rec trackRecord) error
+	//Get returns the track with the given id
+	Get(id string) (trackRecord, error)
+	//List returns all IDs in the order they were registered
+	List() []string
+	//Delete removes the track with the given id for good, deleted or not
+	Delete(id string) error
+	//Exists reports if id is registered
+	Exists(id string) bool
+	//SoftDelete hides the track with the given id, as deleted at the given time
+	SoftDelete(id string, at time.Time) error
+	//Restore brings back a soft deleted track
+	Restore(id string) error
+	//ListDeleted returns all soft deleted tracks, in the order they were registered
+	ListDeleted() []trackRecord
+}
+
+//memoryStore is a TrackStore living in memory. Safe for concurrent use.
+type memoryStore struct {
+	mu     sync.RWMutex
+	tracks map[string]trackRecord //live and soft deleted
+	order  []string               //IDs in registration order
+}
+
+//newMemoryStore makes an empty memoryStore
+func newMemoryStore() *memoryStore {
+	return &memoryStore{tracks: make(map[string]trackRecord)}
+}
+
+func (m *memoryStore) Put(rec trackRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if old, ok := m.tracks[rec.ID]; ok {
+		if !old.Deleted.IsZero() {
+			return errTrackDeleted
+		}
+		return errAlreadyRegistered
+	}
+	m.tracks[rec.ID] = rec
+	m.order = append(m.order, rec.ID)
+	return nil
+}
+
+func (m *memoryStore) Get(id string) (trackRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	rec, ok := m.tracks[id]
+	if !ok || !rec.Deleted.IsZero() {
+		return trackRecord{}, errTrackNotFound
+	}
+	return rec, nil
+}
+
+func (m *memoryStore) List() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	//give a new slice so callers can't mess with our order
+	ids := make([]string, 0, len(m.order))
+	for _, id := range m.order {
+		if m.tracks[id].Deleted.IsZero() {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (m *memoryStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.tracks[id]; !ok {
+		return errTrackNotFound
+	}
+	delete(m.tracks, id)
+	for i := range m.order {
+		if m.order[i] == id {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) Exists(id string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	rec, ok := m.tracks[id]
+	return ok && rec.Deleted.IsZero()
+}
+
+func (m *memoryStore) SoftDelete(id string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rec, ok := m.tracks[id]
+	if !ok || !rec.Deleted.IsZero() {
+		return errTrackNotFound
+	}
+	rec.Deleted = at
+	m.tracks[id] = rec
+	return nil
+}
+
+func (m *memoryStore) Restore(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rec, ok := m.tracks[id]
+	if !ok || rec.Deleted.IsZero() {
+		return errTrackNotFound
+	}
+	rec.Deleted = time.Time{}
+	m.tracks[id] = rec
+	return nil
+}
+
+func (m *memoryStore) ListDeleted() []trackRecord {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var recs []trackRecord
+	for _, id := range m.order {
+		if rec := m.tracks[id]; !rec.Deleted.IsZero() {
+			recs = append(recs, rec)
+		}
+	}
+	return recs
+}
+
+//getAny returns the track with the given id, deleted or not
+func (m *memoryStore) getAny(id string) (trackRecord, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	rec, ok := m.tracks[id]
+	return rec, ok
+}
+
+//sortRecords puts recs in the order they were registered
+func sortRecords(recs []trackRecord) {
+	sort.SliceStable(recs, func(i, j int) bool {
+		return recs[i].Registered.Before(recs[j].Registered)
+	})
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	igc "github.com/marni/goigc"
+)
+
+//errNoTask is given for tracks without C records
+var errNoTask = errors.New("Track has no declared task")
+
+//observation zone types
+const (
+	zoneCylinder = "cylinder"
+	zoneSector   = "sector"
+	zoneLine     = "line"
+)
+
+//ObservationZone is the area around a task point that must be reached
+type ObservationZone struct {
+	Type   string  `json:"type"`   //cylinder, sector (FAI 90 degree sector) or line
+	Radius float64 `json:"radius"` //km. Half the length for lines. 0 makes sectors endless.
+}
+
+//TaskZones are the observation zones used for each kind of task point.
+//Set them with TASK_ZONES, as json with the ones to change, like {"turnpoint": {"type": "sector", "radius": 3}}.
+type TaskZones struct {
+	Start     ObservationZone `json:"start"`
+	Turnpoint ObservationZone `json:"turnpoint"`
+	Finish    ObservationZone `json:"finish"`
+}
+
+//defaultTaskZones are what most competitions use
+var defaultTaskZones = TaskZones{
+	Start:     ObservationZone{zoneLine, 5},
+	Turnpoint: ObservationZone{zoneCylinder, 0.5},
+	Finish:    ObservationZone{zoneLine, 5},
+}
+
+//parseTaskZones reads zones in json, starting from the defaults
+func parseTaskZones(s string) (TaskZones, error) {
+	zones := defaultTaskZones
+	if s == "" {
+		return zones, nil
+	}
+	err := json.Unmarshal([]byte(s), &zones)
+	if err != nil {
+		return zones, err
+	}
+	return zones, zones.check()
+}
+
+//check reports zones that make no sense
+func (z TaskZones) check() error {
+	for _, oz := range []ObservationZone{z.Start, z.Turnpoint, z.Finish} {
+		if oz.Type != zoneCylinder && oz.Type != zoneSector && oz.Type != zoneLine {
+			return fmt.Errorf("unknown zone type %q, use cylinder, sector or line", oz.Type)
+		}
+		if oz.Radius < 0 || (oz.Radius == 0 && oz.Type != zoneSector) {
+			return fmt.Errorf("%s radius must be more than 0", oz.Type)
+		}
+	}
+	if z.Turnpoint.Type == zoneLine {
+		return fmt.Errorf("turnpoints can not be lines")
+	}
+	return nil
+}
+
+//parseZone reads a zone given like "cylinder" or "cylinder:0.5".
+//Without a radius, the one in def is kept.
+func parseZone(s string, def ObservationZone) (ObservationZone, error) {
+	parts := strings.SplitN(s, ":", 2)
+	oz := ObservationZone{parts[0], def.Radius}
+	if len(parts) == 2 {
+		r, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return oz, fmt.Errorf("radius must be a number of km, not %q", parts[1])
+		}
+		oz.Radius = r
+	}
+	return oz, nil
+}
+
+//TaskCheck is how a flight did on its declared task
+type TaskCheck struct {
+	Completed    bool             `json:"completed"`          //every point was reached in order
+	Achieved     int              `json:"achieved"`           //points reached in order, start and finish included
+	Total        int              `json:"total"`              //points in the task
+	TaskDistance float64          `json:"task_distance"`      //km from start through the turnpoints to finish
+	StartTime    *time.Time       `json:"start_time"`         //missing if the start was not reached
+	FinishTime   *time.Time       `json:"finish_time"`        //missing if the task was not completed
+	Duration     string           `json:"duration,omitempty"` //ISO8601, start to finish
+	Speed        float64          `json:"speed,omitempty"`    //km/h over the task distance
+	Points       []TaskCheckPoint `json:"points"`
+	Zones        TaskZones        `json:"zones"` //the zones checked against
+}
+
+//TaskCheckPoint is one point of the task
+type TaskCheckPoint struct {
+	Name        string          `json:"name"`        //start, turnpoint 1, ..., finish
+	Description string          `json:"description"` //from the C record
+	Lat         float64         `json:"lat"`
+	Lng         float64         `json:"lng"`
+	Zone        ObservationZone `json:"zone"`
+	Reached     bool            `json:"reached"`
+	Time        *time.Time      `json:"time,omitempty"` //when it was reached
+}
+
+//taskZone is a task point with everything needed to tell if a fix reached it
+type taskZone struct {
+	center    igc.Point
+	zone      ObservationZone
+	direction float64 //degrees. For sectors, the middle of the sector. For lines, the way they must be crossed.
+}
+
+//hasTask reports if t holds a declared task
+func hasTask(t igc.Task) bool {
+	return t.Start.Lat != 0 || t.Start.Lng != 0 || len(t.Turnpoints) > 0
+}
+
+//newTaskZones places zones on each point of task
+func newTaskZones(task igc.Task, zones TaskZones) []taskZone {
+	pts := append([]igc.Point{task.Start}, task.Turnpoints...)
+	pts = append(pts, task.Finish)
+
+	tz := make([]taskZone, len(pts))
+	for k, p := range pts {
+		tz[k].center = p
+		switch k {
+		case 0:
+			//lines are crossed towards the first turnpoint, sectors point away from it
+			tz[k].zone = zones.Start
+			tz[k].direction = bearing(p, pts[1])
+			if tz[k].zone.Type == zoneSector {
+				tz[k].direction = normalizeBearing(tz[k].direction + 180)
+			}
+		case len(pts) - 1:
+			//both lines and sectors face the way we came in
+			tz[k].zone = zones.Finish
+			tz[k].direction = bearing(pts[k-1], p)
+		default:
+			//the sector points away from the inside of the turn
+			tz[k].zone = zones.Turnpoint
+			in, out := bearing(p, pts[k-1]), bearing(p, pts[k+1])
+			tz[k].direction = normalizeBearing(in + turnAngle(in, out)/2 + 180)
+		}
+	}
+	return tz
+}
+
+//reached reports if fix i of pts reached the zone. Lines are reached by the
+//fix after crossing them.
+func (tz taskZone) reached(pts []igc.Point, i int) bool {
+	p := pts[i]
+	switch tz.zone.Type {
+	case zoneCylinder:
+		return tz.center.Distance(p) <= tz.zone.Radius
+	case zoneSector:
+		if tz.zone.Radius > 0 && tz.center.Distance(p) > tz.zone.Radius {
+			return false
+		}
+		return math.Abs(turnAngle(tz.direction, bearing(tz.center, p))) <= 45
+	default:
+		if i == 0 {
+			return false
+		}
+		//along is how far past the line in the crossing direction, across how far along it
+		h := tz.direction * math.Pi / 180
+		ax, ay := localXY(tz.center, pts[i-1])
+		bx, by := localXY(tz.center, p)
+		alongA := ax*math.Sin(h) + ay*math.Cos(h)
+		alongB := bx*math.Sin(h) + by*math.Cos(h)
+		if alongA >= 0 || alongB < 0 {
+			return false
+		}
+		f := -alongA / (alongB - alongA)
+		x, y := ax+f*(bx-ax), ay+f*(by-ay)
+		across := x*math.Cos(h) - y*math.Sin(h)
+		return math.Abs(across) <= tz.zone.Radius
+	}
+}
+
+//localXY is where p is from center, in km east and north. Good enough near center.
+func localXY(center, p igc.Point) (float64, float64) {
+	x := (p.Lng.Radians() - center.Lng.Radians()) * math.Cos(center.Lat.Radians()) * igc.EarthRadius
+	y := (p.Lat.Radians() - center.Lat.Radians()) * igc.EarthRadius
+	return x, y
+}
+
+//checkTask follows pts through the zones of task in order.
+//The start is taken as the last time it was reached before the first turnpoint.
+func checkTask(pts []igc.Point, times []time.Time, task igc.Task, zones TaskZones) TaskCheck {
+	tz := newTaskZones(task, zones)
+	tc := TaskCheck{
+		Total:        len(tz),
+		TaskDistance: task.Distance(),
+		Points:       make([]TaskCheckPoint, len(tz)),
+		Zones:        zones,
+	}
+	for k, z := range tz {
+		name := fmt.Sprintf("turnpoint %d", k)
+		if k == 0 {
+			name = "start"
+		} else if k == len(tz)-1 {
+			name = "finish"
+		}
+		tc.Points[k] = TaskCheckPoint{
+			Name:        name,
+			Description: strings.TrimSpace(z.center.Description),
+			Lat:         z.center.Lat.Degrees(),
+			Lng:         z.center.Lng.Degrees(),
+			Zone:        z.zone,
+		}
+	}
+
+	//hit[k] is the fix that reached zone k, -1 if none
+	hit := make([]int, len(tz))
+	for k := range hit {
+		hit[k] = -1
+	}
+	for i := range pts {
+		if tz[0].reached(pts, i) {
+			hit[0] = i
+			break
+		}
+	}
+	from := hit[0] + 1 //search the rest from after the start, or from the beginning
+	for k := 1; k < len(tz); k++ {
+		for i := from; i < len(pts); i++ {
+			if tz[k].reached(pts, i) {
+				hit[k] = i
+				break
+			}
+		}
+		if hit[k] < 0 {
+			break
+		}
+		if k == 1 && hit[0] >= 0 {
+			//restarts: the last start before the first turnpoint counts
+			for i := hit[1] - 1; i > hit[0]; i-- {
+				if tz[0].reached(pts, i) {
+					hit[0] = i
+					break
+				}
+			}
+		}
+		from = hit[k] + 1
+	}
+
+	for k, i := range hit {
+		if i < 0 {
+			break
+		}
+		t := times[i]
+		tc.Points[k].Reached = true
+		tc.Points[k].Time = &t
+		tc.Achieved++
+	}
+	if hit[0] >= 0 {
+		tc.StartTime = tc.Points[0].Time
+	}
+	if hit[0] >= 0 && hit[len(hit)-1] >= 0 {
+		tc.Completed = true
+		tc.FinishTime = tc.Points[len(hit)-1].Time
+		dur := tc.FinishTime.Sub(*tc.StartTime)
+		tc.Duration = isoDuration(dur)
+		if dur > 0 {
+			tc.Speed = tc.TaskDistance / dur.Hours()
+		}
+	}
+	return tc
+}
+
+//writes how the flight did on its declared task. Zones can be changed
+//for one request with ?start=, ?turnpoint= and ?finish=, like ?turnpoint=sector:3
+func (s *server) handlAPIigcIDtask(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	zones := s.zones
+	var err error
+	q := r.URL.Query()
+	for _, z := range []struct {
+		name string
+		zone *ObservationZone
+	}{{"start", &zones.Start}, {"turnpoint", &zones.Turnpoint}, {"finish", &zones.Finish}} {
+		if v := q.Get(z.name); v != "" {
+			*z.zone, err = parseZone(v, *z.zone)
+			if err != nil {
+				errorHandler(w, http.StatusBadRequest, fmt.Sprintf("Error: %s %s", z.name, err))
+				return
+			}
+		}
+	}
+	if err = zones.check(); err != nil {
+		errorHandler(w, http.StatusBadRequest, fmt.Sprintf("Error: %s", err))
+		return
+	}
+
+	rec, err := s.store.Get(vars["ID"])
+	if err != nil {
+		errorHandler(w, http.StatusNotFound, fmt.Sprintf("Error: %s", err))
+		return
+	}
+	if !hasTask(rec.Track.Task) {
+		errorHandler(w, http.StatusNotFound, fmt.Sprintf("Error: %s", errNoTask))
+		return
+	}
+	pts, times := rec.flightPoints(includeGround(r))
+	writeJSON(w, checkTask(pts, times, rec.Track.Task, zones))
+}
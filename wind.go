@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	igc "github.com/marni/goigc"
+)
+
+//limits for wind estimation
+const (
+	defaultWindBand = 500 //metres of altitude per band in the wind profile
+	minCircleFixes  = 8   //a circle with fewer ground speeds than this is too rough to use
+)
+
+//WindEstimate is the wind worked out from one full circle
+type WindEstimate struct {
+	Time      time.Time `json:"time"`      //middle of the circle
+	Altitude  int64     `json:"altitude"`  //pressure altitude in metres, middle of the circle
+	Speed     float64   `json:"speed"`     //km/h
+	Direction float64   `json:"direction"` //degrees the wind blows from
+	Airspeed  float64   `json:"airspeed"`  //km/h, how fast the glider flew through the air
+}
+
+//WindBand is the average wind in one altitude band
+type WindBand struct {
+	MinAltitude int64   `json:"min_altitude"`
+	MaxAltitude int64   `json:"max_altitude"`
+	Speed       float64 `json:"speed"`
+	Direction   float64 `json:"direction"`
+	Estimates   int     `json:"estimates"` //circles the average is made of
+}
+
+//WindProfile is the wind a track flew in, by time and by altitude
+type WindProfile struct {
+	Estimates []WindEstimate `json:"estimates"` //in time order
+	Bands     []WindBand     `json:"bands"`     //lowest first, only bands we have estimates for
+}
+
+//velocity is a ground speed as east and north parts, in km/h
+type velocity struct {
+	east, north float64
+}
+
+//estimateWind works out the wind from every full circle in pts.
+//
+//Flying circles at a steady airspeed, the ground speed is highest downwind and
+//lowest upwind. Drawn as east/north velocities, the ground speeds around a
+//circle lie on a circle whose centre is the wind and whose radius is the airspeed.
+func estimateWind(pts []igc.Point, times []time.Time) []WindEstimate {
+	estimates := []WindEstimate{}
+	for _, ph := range findPhases(pts, times) {
+		if !ph.circling {
+			continue
+		}
+		end := ph.end
+		if end < len(pts)-1 {
+			end++
+		}
+		for _, c := range splitCircles(pts, ph.start, end) {
+			est, ok := circleWind(pts, times, c[0], c[1])
+			if ok {
+				estimates = append(estimates, est)
+			}
+		}
+	}
+	return estimates
+}
+
+//splitCircles cuts pts from a to b into full turns of 360 degrees,
+//as pairs of first and last point. What's left after the last full turn is dropped.
+func splitCircles(pts []igc.Point, a, b int) [][2]int {
+	var circles [][2]int
+	start, turned := a, 0.0
+	last := -1.0 //heading of the last segment that moved
+	for i := a; i < b; i++ {
+		if pts[i].Distance(pts[i+1]) < minHeadingMove {
+			continue
+		}
+		h := bearing(pts[i], pts[i+1])
+		if last >= 0 {
+			turned += turnAngle(last, h)
+		}
+		last = h
+		if math.Abs(turned) >= 360 {
+			circles = append(circles, [2]int{start, i + 1})
+			start, turned, last = i+1, 0, -1
+		}
+	}
+	return circles
+}
+
+//circleWind fits a circle to the ground speeds from point a to b
+func circleWind(pts []igc.Point, times []time.Time, a, b int) (WindEstimate, bool) {
+	var vs []velocity
+	for i := a; i < b; i++ {
+		dt := times[i+1].Sub(times[i]).Hours()
+		if dt <= 0 {
+			continue
+		}
+		speed := pts[i].Distance(pts[i+1]) / dt
+		h := bearing(pts[i], pts[i+1]) * math.Pi / 180
+		vs = append(vs, velocity{speed * math.Sin(h), speed * math.Cos(h)})
+	}
+	if len(vs) < minCircleFixes {
+		return WindEstimate{}, false
+	}
+
+	centre, radius, ok := fitCircle(vs)
+	if !ok {
+		return WindEstimate{}, false
+	}
+	mid := (a + b) / 2
+	return WindEstimate{
+		Time:      times[mid],
+		Altitude:  pts[mid].PressureAltitude,
+		Speed:     math.Hypot(centre.east, centre.north),
+		Direction: windFrom(centre),
+		Airspeed:  radius,
+	}, true
+}
+
+//fitCircle finds the circle closest to vs, by least squares on
+//x²+y² = 2ax + 2by + c, where (a, b) is the centre
+func fitCircle(vs []velocity) (velocity, float64, bool) {
+	//normal equations, m * (2a, 2b, c) = rhs
+	var m [3][3]float64
+	var rhs [3]float64
+	for _, v := range vs {
+		row := [3]float64{v.east, v.north, 1}
+		z := v.east*v.east + v.north*v.north
+		for i := range row {
+			for j := range row {
+				m[i][j] += row[i] * row[j]
+			}
+			rhs[i] += row[i] * z
+		}
+	}
+
+	det := det3(m)
+	if math.Abs(det) < 1e-9 {
+		return velocity{}, 0, false //all on a line, we did not really circle
+	}
+	var p [3]float64
+	for k := range p {
+		mk := m
+		for i := range mk {
+			mk[i][k] = rhs[i]
+		}
+		p[k] = det3(mk) / det
+	}
+
+	centre := velocity{p[0] / 2, p[1] / 2}
+	r2 := p[2] + centre.east*centre.east + centre.north*centre.north
+	if r2 <= 0 {
+		return velocity{}, 0, false
+	}
+	return centre, math.Sqrt(r2), true
+}
+
+func det3(m [3][3]float64) float64 {
+	return m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+}
+
+//windFrom is the direction a wind blowing with velocity v comes from
+func windFrom(v velocity) float64 {
+	return normalizeBearing(math.Atan2(v.east, v.north)*180/math.Pi + 180)
+}
+
+//windBands averages estimates in altitude bands of the given height.
+//Winds are averaged as vectors, so 350 and 10 degrees give 0 and not 180.
+func windBands(estimates []WindEstimate, band int64) []WindBand {
+	sums := make(map[int64]*velocity)
+	counts := make(map[int64]int)
+	for _, e := range estimates {
+		k := e.Altitude / band
+		if e.Altitude < 0 && e.Altitude%band != 0 {
+			k-- //round down below sea level too
+		}
+		if sums[k] == nil {
+			sums[k] = &velocity{}
+		}
+		//back to the velocity the wind blows with
+		h := e.Direction * math.Pi / 180
+		sums[k].east -= e.Speed * math.Sin(h)
+		sums[k].north -= e.Speed * math.Cos(h)
+		counts[k]++
+	}
+
+	bands := []WindBand{}
+	for k, sum := range sums {
+		n := float64(counts[k])
+		avg := velocity{sum.east / n, sum.north / n}
+		bands = append(bands, WindBand{
+			MinAltitude: k * band,
+			MaxAltitude: (k + 1) * band,
+			Speed:       math.Hypot(avg.east, avg.north),
+			Direction:   windFrom(avg),
+			Estimates:   counts[k],
+		})
+	}
+	sort.Slice(bands, func(i, j int) bool {
+		return bands[i].MinAltitude < bands[j].MinAltitude
+	})
+	return bands
+}
+
+//writes the wind profile of a track
+func (s *server) handlAPIigcIDwind(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	band := int64(defaultWindBand)
+	if v := r.URL.Query().Get("band"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			errorHandler(w, http.StatusBadRequest, "Error: band must be a positive number of metres")
+			return
+		}
+		band = n
+	}
+
+	rec, err := s.store.Get(vars["ID"])
+	if err != nil {
+		errorHandler(w, http.StatusNotFound, fmt.Sprintf("Error: %s", err))
+		return
+	}
+	estimates := estimateWind(rec.flightPoints(includeGround(r)))
+	writeJSON(w, WindProfile{estimates, windBands(estimates, band)})
+}